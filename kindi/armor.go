@@ -0,0 +1,256 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Armored messages wrap the binary .kindi format in a PEM-like text block
+// so it survives being pasted into chat, tickets or email bodies:
+//
+//	-----BEGIN KINDI MESSAGE-----
+//	<base64, 64 characters per line>
+//	=<base64 of the 24-bit CRC of the binary data>
+//	-----END KINDI MESSAGE-----
+const (
+	armorBegin      = "-----BEGIN KINDI MESSAGE-----"
+	armorEnd        = "-----END KINDI MESSAGE-----"
+	armorLineLength = 64
+)
+
+// CRC-24 as used by OpenPGP armor (RFC 4880, section 6.1).
+const (
+	crc24Init = 0xb704ce
+	crc24Poly = 0x1864cfb
+)
+
+func crc24Update(crc uint32, p []byte) uint32 {
+	for _, b := range p {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+func crc24Bytes(crc uint32) []byte {
+	return []byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}
+}
+
+type armorWriter struct {
+	w    io.Writer
+	line []byte
+	crc  uint32
+	err  error
+}
+
+// newArmorWriter returns a writer that armors everything written to it into w.
+// Close must be called to flush the last line and write the checksum and footer.
+func newArmorWriter(w io.Writer) (io.WriteCloser, error) {
+	_, err := io.WriteString(w, armorBegin+"\n")
+	if err != nil {
+		return nil, err
+	}
+	rv := new(armorWriter)
+	rv.w = w
+	rv.line = make([]byte, 0, base64.StdEncoding.DecodedLen(armorLineLength))
+	rv.crc = crc24Init
+	return rv, nil
+}
+
+func (aw *armorWriter) writeLine(raw []byte) error {
+	_, err := io.WriteString(aw.w, base64.StdEncoding.EncodeToString(raw)+"\n")
+	return err
+}
+
+func (aw *armorWriter) Write(p []byte) (n int, err error) {
+	if aw.err != nil {
+		return 0, aw.err
+	}
+
+	aw.crc = crc24Update(aw.crc, p)
+
+	for len(p) > 0 {
+		k := copy(aw.line[len(aw.line):cap(aw.line)], p)
+		aw.line = aw.line[:len(aw.line)+k]
+		p = p[k:]
+		n += k
+
+		if len(aw.line) == cap(aw.line) {
+			aw.err = aw.writeLine(aw.line)
+			if aw.err != nil {
+				return n, aw.err
+			}
+			aw.line = aw.line[:0]
+		}
+	}
+	return n, nil
+}
+
+func (aw *armorWriter) Close() error {
+	if aw.err != nil {
+		return aw.err
+	}
+
+	if len(aw.line) > 0 {
+		aw.err = aw.writeLine(aw.line)
+		if aw.err != nil {
+			return aw.err
+		}
+		aw.line = aw.line[:0]
+	}
+
+	_, err := io.WriteString(aw.w, "="+base64.StdEncoding.EncodeToString(crc24Bytes(aw.crc))+"\n"+armorEnd+"\n")
+	return err
+}
+
+type armorReader struct {
+	br   *bufio.Reader
+	buf  []byte
+	crc  uint32
+	done bool
+	err  error
+}
+
+func newArmorReader(br *bufio.Reader) *armorReader {
+	rv := new(armorReader)
+	rv.br = br
+	rv.crc = crc24Init
+	return rv
+}
+
+func (ar *armorReader) readLine() (string, error) {
+	line, err := ar.br.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return strings.TrimSpace(line), err
+}
+
+func (ar *armorReader) fill() error {
+	if ar.done {
+		return io.EOF
+	}
+
+	for {
+		line, err := ar.readLine()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(line) == 0:
+			continue
+		case line == armorBegin:
+			continue
+		case line == armorEnd:
+			return &FormatError{Field: "armor", Err: errors.New("missing checksum")}
+		case line[0] == '=':
+			sum, err := base64.StdEncoding.DecodeString(line[1:])
+			if err != nil || len(sum) != 3 {
+				return &FormatError{Field: "armor", Err: errors.New("malformed checksum line")}
+			}
+			end, err := ar.readLine()
+			if err != nil {
+				return err
+			}
+			if end != armorEnd {
+				return &FormatError{Field: "armor", Err: fmt.Errorf("missing %s", armorEnd)}
+			}
+			if !bytes.Equal(sum, crc24Bytes(ar.crc)) {
+				return &FormatError{Field: "armor", Err: errors.New("checksum mismatch")}
+			}
+			ar.done = true
+			return ar.checkRest()
+		}
+
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return &FormatError{Field: "armor", Err: fmt.Errorf("malformed base64: %v", err)}
+		}
+		ar.crc = crc24Update(ar.crc, data)
+		ar.buf = data
+		return nil
+	}
+}
+
+// checkRest returns io.EOF if only whitespace follows the armor footer.
+func (ar *armorReader) checkRest() error {
+	for {
+		b, err := ar.br.ReadByte()
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b)) {
+			return &FormatError{Field: "armor", Err: fmt.Errorf("data after %s", armorEnd)}
+		}
+	}
+}
+
+func (ar *armorReader) Read(p []byte) (n int, err error) {
+	for len(ar.buf) == 0 {
+		if ar.err != nil {
+			return 0, ar.err
+		}
+		ar.err = ar.fill()
+	}
+
+	n = copy(p, ar.buf)
+	ar.buf = ar.buf[n:]
+	return n, nil
+}
+
+// dearmor returns a reader yielding the binary .kindi stream from r,
+// transparently decoding it if r holds an armored message.
+func dearmor(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+
+	peek, _ := br.Peek(len(armorBegin) + 16)
+	if bytes.HasPrefix(bytes.TrimLeft(peek, " \t\r\n"), []byte(armorBegin)) {
+		return newArmorReader(br)
+	}
+	return br
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestArmorRoundtrip(t *testing.T) {
+	for _, size := range []int{0, 1, 47, 48, 49, 1000} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i * 7)
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 1024))
+		aw, err := newArmorWriter(buf)
+		if err != nil {
+			t.Fatalf("failed to create armor writer %v", err)
+		}
+		_, err = aw.Write(payload)
+		if err != nil {
+			t.Fatalf("failed to write armored payload %v", err)
+		}
+		err = aw.Close()
+		if err != nil {
+			t.Fatalf("failed to close armor writer %v", err)
+		}
+
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if len(line) > armorLineLength {
+				t.Fatalf("armored line longer than %d characters: %q", armorLineLength, line)
+			}
+		}
+
+		out, err := ioutil.ReadAll(dearmor(buf))
+		if err != nil {
+			t.Fatalf("failed to dearmor %v", err)
+		}
+		if !bytes.Equal(out, payload) {
+			t.Fatalf("dearmored payload different from original payload (size %d)", size)
+		}
+	}
+}
+
+func TestArmorChecksum(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	aw, err := newArmorWriter(buf)
+	if err != nil {
+		t.Fatalf("failed to create armor writer %v", err)
+	}
+	aw.Write([]byte("attack at dawn"))
+	aw.Close()
+
+	tampered := strings.Replace(buf.String(), "YXR0YWNr", "YXR0YWNl", 1)
+	if tampered == buf.String() {
+		t.Fatalf("test did not tamper with armored text")
+	}
+
+	_, err = ioutil.ReadAll(dearmor(strings.NewReader(tampered)))
+	if err == nil {
+		t.Fatalf("expected checksum error for tampered armored text")
+	}
+}
+
+func TestEncryptArmored(t *testing.T) {
+	payload := []byte("some text that needs to survive being pasted into an email body")
+
+	envelope, sender, recipient := newTestEnvelope(t)
+
+	outbuffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	aw, err := newArmorWriter(outbuffer)
+	if err != nil {
+		t.Fatalf("failed to create armor writer %v", err)
+	}
+	err = envelope.encrypt(aw, bytes.NewBuffer(payload), []byte("foo.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	err = aw.Close()
+	if err != nil {
+		t.Fatalf("failed to close armor writer %v", err)
+	}
+
+	armored := "\n" + outbuffer.String()
+
+	roundtripbuffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	err = decrypt(roundtripbuffer, strings.NewReader(armored), recipient, func(email []byte) (*rsa.PublicKey, error) {
+		return sender, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+
+	if !bytes.Equal(roundtripbuffer.Bytes(), payload) {
+		t.Fatalf("decrypted payload different from original payload")
+	}
+}
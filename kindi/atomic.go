@@ -0,0 +1,102 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is an output file written under a temporary name next to its
+// final path, so a crash, a full disk or a failed decryption never leaves a
+// truncated file behind under the name the user asked for.
+type atomicFile struct {
+	*os.File
+	done bool
+}
+
+// createAtomic creates a temporary file with permissions perm, less the
+// umask, in dir, the directory commit will move it into.
+func createAtomic(dir string, perm os.FileMode) (*atomicFile, error) {
+	f, err := ioutil.TempFile(dir, ".kindi-")
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Chmod(perm &^ umask())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{File: f}, nil
+}
+
+// commit flushes the file to disk and renames it to path, replacing
+// whatever is there. The file is removed if any step fails.
+func (f *atomicFile) commit(path string) error {
+	if f.done {
+		return os.ErrClosed
+	}
+	f.done = true
+
+	err := f.Sync()
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// make the rename itself durable, not every platform can sync a directory
+	d, err := os.Open(filepath.Dir(path))
+	if err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// abort closes and removes the file unless it has been committed, so it
+// can be deferred right after createAtomic.
+func (f *atomicFile) abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kindi-atomic")
+	if err != nil {
+		t.Fatalf("failed to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.txt")
+	err = ioutil.WriteFile(path, []byte("old"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+
+	f, err := createAtomic(dir, 0644)
+	if err != nil {
+		t.Fatalf("failed to create %v", err)
+	}
+	f.Write([]byte("partial"))
+	f.abort()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "old" {
+		t.Fatalf("expected an aborted write to leave the old file alone, got %q, %v", data, err)
+	}
+
+	f, err = createAtomic(dir, 0600)
+	if err != nil {
+		t.Fatalf("failed to create %v", err)
+	}
+	defer f.abort()
+	f.Write([]byte("new"))
+
+	err = f.commit(path)
+	if err != nil {
+		t.Fatalf("failed to commit %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v, %v", fi, err)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("expected the committed file to replace the old one, got %q, %v", data, err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected no temporary files left behind, got %d entries, %v", len(entries), err)
+	}
+
+	f, err = createAtomic(dir, 0666)
+	if err != nil {
+		t.Fatalf("failed to create %v", err)
+	}
+	defer f.abort()
+
+	fi, err = os.Stat(f.Name())
+	if err != nil || fi.Mode().Perm() != 0666&^umask() {
+		t.Fatalf("expected mode %04o after the umask, got %v, %v", 0666&^umask(), fi, err)
+	}
+}
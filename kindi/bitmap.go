@@ -29,95 +29,612 @@
 package kindi
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
-	"image/color"
 	_ "image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 )
 
+// lsbLayout says which low bits of a pixel carry payload bits.
+type lsbLayout struct {
+	bits  int  // low bits used per channel, 1 to 4
+	alpha bool // use the alpha channel besides red, green and blue
+}
+
+// defaultLayout is what kindi has always used: the lowest bit of red, green and blue.
+var defaultLayout = lsbLayout{bits: 1}
+
+const layoutAlphaFlag = 0x10
+
+func (l lsbLayout) channels() int {
+	if l.alpha {
+		return 4
+	}
+	return 3
+}
+
+func (l lsbLayout) encode() byte {
+	rv := byte(l.bits)
+	if l.alpha {
+		rv |= layoutAlphaFlag
+	}
+	return rv
+}
+
+func (l lsbLayout) String() string {
+	if l.alpha {
+		return fmt.Sprintf("%d bits of RGBA", l.bits)
+	}
+	return fmt.Sprintf("%d bits of RGB", l.bits)
+}
+
+func decodeLayout(b byte) (lsbLayout, error) {
+	l := lsbLayout{bits: int(b & 0x0f), alpha: b&layoutAlphaFlag != 0}
+	if l.bits < 1 || l.bits > 4 || b&^(0x0f|layoutAlphaFlag) != 0 {
+		return l, fmt.Errorf("invalid layout 0x%02x", b)
+	}
+	return l, nil
+}
+
+// StegoOptions select how payloads are embedded into images. A nil
+// *StegoOptions selects the defaults. Decoding doesn't need them, the frame
+// records the layout.
+type StegoOptions struct {
+	// BitsPerChannel is the number of low bits used per channel, 1 to 4.
+	// 0 means 1. More bits mean more capacity and more visible noise.
+	BitsPerChannel int
+
+	// Alpha uses the alpha channel too.
+	Alpha bool
+
+	// Key, if set, scatters the payload over the image in an order derived
+	// from it instead of filling pixels from the top left corner. Decoding
+	// needs the same key. Use a public value (like the gmail address of the
+	// owner) to merely spread the payload or a shared secret to hide it.
+	Key []byte
+
+	// Redundancy is the number of Reed-Solomon parity bytes added per 255
+	// byte codeword, a multiple of 8 up to 56. Each 8 bytes let decoding
+	// repair up to 4 damaged bytes per codeword. 0 means no error correction.
+	Redundancy int
+}
+
+func (opts *StegoOptions) key() []byte {
+	if opts == nil {
+		return nil
+	}
+	return opts.Key
+}
+
+func (opts *StegoOptions) parity() (int, error) {
+	if opts == nil {
+		return 0, nil
+	}
+	return opts.Redundancy, checkParity(opts.Redundancy)
+}
+
+func (opts *StegoOptions) layout() (lsbLayout, error) {
+	if opts == nil {
+		return defaultLayout, nil
+	}
+	l := lsbLayout{bits: opts.BitsPerChannel, alpha: opts.Alpha}
+	if l.bits == 0 {
+		l.bits = 1
+	}
+	if l.bits < 1 || l.bits > 4 {
+		return l, fmt.Errorf("bits per channel must be between 1 and 4, got %d", opts.BitsPerChannel)
+	}
+	return l, nil
+}
+
+// ErrImageTooSmall is returned (wrapped) by EncodePNG if the payload doesn't
+// fit into the image.
+var ErrImageTooSmall = errors.New("image too small to hold payload")
+
+// lsbSize returns the number of bytes the default layout of an image with
+// bounds b can hold.
+func lsbSize(b image.Rectangle) int {
+	return b.Dx() * b.Dy() * 3 / 8
+}
+
+// frameBodySize returns the number of bytes left after the frame preamble in
+// an image with bounds b when using layout l.
+func frameBodySize(b image.Rectangle, l lsbLayout) int {
+	pixels := b.Dx() * b.Dy()
+	preamblePixels := (framePreambleSize*8 + 2) / 3
+	if pixels < preamblePixels {
+		return -1
+	}
+	return (pixels - preamblePixels) * l.channels() * l.bits / 8
+}
+
+func capacityOf(b image.Rectangle, l lsbLayout, parity int) int {
+	rv := unprotectedSize(frameBodySize(b, l), parity) - (frameSize([]PayloadItem{{}}) - framePreambleSize)
+	if rv < 0 {
+		return 0
+	}
+	return rv
+}
+
+// Capacity returns the number of payload bytes EncodePNG can embed into m.
+func Capacity(m image.Image) int {
+	return capacityOf(m.Bounds(), defaultLayout, 0)
+}
+
+// CapacityWithOptions returns the number of bytes a single item embedded into
+// m with opts can have.
+func CapacityWithOptions(m image.Image, opts *StegoOptions) (int, error) {
+	l, err := opts.layout()
+	if err != nil {
+		return 0, err
+	}
+	parity, err := opts.parity()
+	if err != nil {
+		return 0, err
+	}
+	return capacityOf(m.Bounds(), l, parity), nil
+}
+
 func EncodePNG(w io.Writer, payload []byte, m image.Image) error {
-	nrgba := newNRGBAImageLSBReaderWriter(m)
+	return EncodeItemsPNG(w, []PayloadItem{{Type: PayloadCertificate, Data: payload}}, m, nil)
+}
 
-	err := writeLengthEncoded(nrgba, payload)
+// EncodeItemsPNG embeds items into m as selected by opts and writes the
+// result as PNG to w.
+func EncodeItemsPNG(w io.Writer, items []PayloadItem, m image.Image, opts *StegoOptions) error {
+	nrgba, err := embedItems(items, m, opts)
 	if err != nil {
 		return err
 	}
 
-	return png.Encode(w, nrgba.m)
+	return png.Encode(w, nrgba)
+}
+
+// embedItems returns a copy of m with items embedded into its low bits as
+// selected by opts.
+func embedItems(items []PayloadItem, m image.Image, opts *StegoOptions) (*image.NRGBA, error) {
+	l, err := opts.layout()
+	if err != nil {
+		return nil, err
+	}
+	parity, err := opts.parity()
+	if err != nil {
+		return nil, err
+	}
+
+	size := protectedSize(frameSize(items)-framePreambleSize, parity)
+	available := frameBodySize(m.Bounds(), l)
+	if size > available {
+		return nil, fmt.Errorf("%w: payload needs %d bytes, image holds %d bytes", ErrImageTooSmall, size, available)
+	}
+
+	nrgba := newNRGBAImageLSBReaderWriter(m)
+	nrgba.setKey(opts.key())
+
+	err = writeFrame(nrgba, items, l, parity)
+	if err != nil {
+		return nil, err
+	}
+
+	return nrgba.m, nil
 }
 
+// fitImage scales m up (nearest neighbour, by an integer factor) until c can
+// embed payloadSize bytes into it with opts. Images that are big enough are
+// returned as is.
+func fitImage(m image.Image, payloadSize int, c carrier, opts *StegoOptions) (image.Image, error) {
+	capacity, err := c.capacity(m.Bounds(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if capacity >= payloadSize {
+		return m, nil
+	}
+
+	b := m.Bounds()
+	if b.Empty() {
+		b = image.Rect(0, 0, 1, 1)
+		m = image.NewNRGBA(b)
+	}
+
+	factor := 2
+	for {
+		scaled, err := c.capacity(image.Rect(0, 0, b.Dx()*factor, b.Dy()*factor), opts)
+		if err != nil {
+			return nil, err
+		}
+		if scaled >= payloadSize {
+			break
+		}
+		if scaled <= capacity {
+			return nil, fmt.Errorf("%w: %s carriers can't hold %d bytes at any size", ErrImageTooSmall, c.name(), payloadSize)
+		}
+		factor++
+	}
+
+	rv := image.NewNRGBA(image.Rect(0, 0, b.Dx()*factor, b.Dy()*factor))
+	for y := 0; y < rv.Rect.Max.Y; y++ {
+		for x := 0; x < rv.Rect.Max.X; x++ {
+			rv.Set(x, y, m.At(b.Min.X+x/factor, b.Min.Y+y/factor))
+		}
+	}
+	return rv, nil
+}
+
+// MaxPayloadSize bounds the size of items DecodePNG is willing to extract,
+// whatever the lengths read from the image claim.
+var MaxPayloadSize = 1 << 20
+
+// MaxImagePixels bounds the size of images DecodePNG and the other carrier
+// formats are willing to decode, whatever their header claims.
+var MaxImagePixels = 1 << 26
+
+var (
+	// ErrNoPayload is returned (wrapped) by DecodePNG for images that don't
+	// carry a kindi payload.
+	ErrNoPayload = errors.New("image carries no kindi payload")
+
+	// ErrPayloadTooLarge is returned (wrapped) by DecodePNG for items bigger
+	// than MaxPayloadSize.
+	ErrPayloadTooLarge = errors.New("kindi payload in image exceeds maximum size")
+
+	// ErrImageTooLarge is returned (wrapped) by DecodePNG and the other
+	// carrier formats for images with more than MaxImagePixels pixels.
+	ErrImageTooLarge = errors.New("image exceeds maximum size")
+)
+
+// pngHeaderSize covers the signature and the IHDR chunk, all
+// png.DecodeConfig needs.
+const pngHeaderSize = 8 + 8 + 13 + 4
+
+// decodePNG decodes a PNG image from rin after checking its dimensions
+// against MaxImagePixels, so a hostile header can't make it allocate
+// gigabytes.
+func decodePNG(rin io.Reader) (image.Image, error) {
+	br := bufio.NewReader(rin)
+
+	header, _ := br.Peek(pngHeaderSize)
+	config, err := png.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		return nil, err
+	}
+	err = checkImageSize(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return png.Decode(br)
+}
+
+func checkImageSize(config image.Config) error {
+	if int64(config.Width)*int64(config.Height) > int64(MaxImagePixels) {
+		return fmt.Errorf("%w: %dx%d pixels", ErrImageTooLarge, config.Width, config.Height)
+	}
+	return nil
+}
+
+// maxEncodedImageSize bounds the size of the images limitedDecoder reads:
+// 8 bytes per pixel, uncompressed 16 bit RGBA, and room for metadata.
+func maxEncodedImageSize() int64 {
+	return 8*int64(MaxImagePixels) + 1<<20
+}
+
+// limitedDecoder returns decode checking the dimensions decodeConfig finds
+// against MaxImagePixels first. Unlike PNG, formats like TIFF may keep their
+// dimensions anywhere in the file, so the encoded image is read into memory,
+// up to maxEncodedImageSize.
+func limitedDecoder(decodeConfig func(io.Reader) (image.Config, error), decode func(io.Reader) (image.Image, error)) func(io.Reader) (image.Image, error) {
+	return func(r io.Reader) (image.Image, error) {
+		limit := maxEncodedImageSize()
+		data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > limit {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrImageTooLarge, limit)
+		}
+
+		config, err := decodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		err = checkImageSize(config)
+		if err != nil {
+			return nil, err
+		}
+
+		return decode(bytes.NewReader(data))
+	}
+}
+
+// DecodePNG returns the certificate embedded in the PNG image read from rin.
 func DecodePNG(rin io.Reader) ([]byte, error) {
-	m, err := png.Decode(rin)
+	cert, _, err := DecodePNGWithCorrections(rin)
+	return cert, err
+}
+
+// DecodePNGWithCorrections is like DecodePNG and also returns the number of
+// damaged bytes error correction repaired, if the payload was embedded with
+// Redundancy.
+func DecodePNGWithCorrections(rin io.Reader) ([]byte, int, error) {
+	m, err := decodePNG(rin)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return decodeImage(m, MaxPayloadSize)
+}
+
+// DecodeItemsPNG returns all items embedded in the PNG image read from rin.
+// Only the Key of opts matters, the layout is read from the image.
+func DecodeItemsPNG(rin io.Reader, opts *StegoOptions) ([]PayloadItem, error) {
+	m, err := decodePNG(rin)
 	if err != nil {
 		return nil, err
 	}
 
+	items, _, err := decodeItems(m, MaxPayloadSize, opts.key())
+	return items, err
+}
+
+func decodeImage(m image.Image, maxSize int) ([]byte, int, error) {
+	items, corrected, err := decodeItems(m, maxSize, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cert, err := certificateItem(items)
+	return cert, corrected, err
+}
+
+// certificateItem returns the data of the first certificate among items.
+func certificateItem(items []PayloadItem) ([]byte, error) {
+	for _, item := range items {
+		if item.Type == PayloadCertificate {
+			return item.Data, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no certificate among %d embedded items", ErrNoPayload, len(items))
+}
+
+func decodeItems(m image.Image, maxSize int, key []byte) ([]PayloadItem, int, error) {
 	nrgba := newNRGBAImageLSBReaderWriter(m)
+	nrgba.setKey(key)
 
-	return readLengthEncoded(nrgba)
+	items, corrected, err := readFrame(nrgba, maxSize)
+	if err != ErrNoPayload || len(key) > 0 {
+		return items, corrected, err
+	}
+
+	// no frame magic, maybe a certificate embedded before payloads were framed
+	nrgba.reset()
+	data, err := readLegacyPayload(nrgba, lsbSize(m.Bounds()), maxSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return []PayloadItem{{Type: PayloadCertificate, Data: data}}, 0, nil
 }
 
+// readLegacyPayload reads the unframed length prefixed payload older versions
+// of kindi embedded, refusing length prefixes that are negative or exceed
+// the capacity of the image or maxSize.
+func readLegacyPayload(r io.Reader, capacity, maxSize int) ([]byte, error) {
+	var dataLen int64
+	err := binary.Read(r, binary.BigEndian, &dataLen)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPayload, err)
+	}
+
+	// an empty legacy payload is more likely an image that happens to have
+	// even values in its first pixels
+	capacity -= 8
+	if dataLen <= 0 || dataLen > int64(capacity) {
+		return nil, fmt.Errorf("%w: length prefix %d doesn't fit image capacity of %d bytes", ErrNoPayload, dataLen, capacity)
+	}
+	if dataLen > int64(maxSize) {
+		return nil, fmt.Errorf("%w: length prefix %d, maximum is %d bytes", ErrPayloadTooLarge, dataLen, maxSize)
+	}
+
+	data := make([]byte, dataLen)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pixelOrder is a pseudo random permutation of the pixels of an image,
+// derived from a key. It is computed lazily (Fisher-Yates, one swap per
+// pixel asked for), so only the pixels that carry payload cost anything.
+type pixelOrder struct {
+	key     []byte
+	stream  cipher.Stream
+	n       int
+	order   []int
+	swapped map[int]int
+}
+
+func newPixelOrder(key []byte, n int) *pixelOrder {
+	rv := new(pixelOrder)
+	rv.key = key
+	rv.n = n
+	rv.reset()
+	return rv
+}
+
+func (po *pixelOrder) reset() {
+	sum := sha256.Sum256(append([]byte("kindi pixel order "), po.key...))
+	c, _ := aes.NewCipher(sum[:])
+	po.stream = cipher.NewCTR(c, make([]byte, aes.BlockSize))
+	po.order = po.order[:0]
+	po.swapped = make(map[int]int)
+}
+
+// uniform returns a number in [0, n) from the key stream.
+func (po *pixelOrder) uniform(n int) int {
+	var buf [8]byte
+	limit := ^uint64(0) - ^uint64(0)%uint64(n)
+	for {
+		buf = [8]byte{}
+		po.stream.XORKeyStream(buf[:], buf[:])
+		v := binary.BigEndian.Uint64(buf[:])
+		if v < limit {
+			return int(v % uint64(n))
+		}
+	}
+}
+
+func (po *pixelOrder) at(i int) int {
+	if v, ok := po.swapped[i]; ok {
+		return v
+	}
+	return i
+}
+
+// pixel returns the index of the i-th pixel of the permutation.
+func (po *pixelOrder) pixel(i int) int {
+	for len(po.order) <= i {
+		k := len(po.order)
+		j := k + po.uniform(po.n-k)
+		vk, vj := po.at(k), po.at(j)
+		po.swapped[j] = vk
+		delete(po.swapped, k)
+		po.order = append(po.order, vj)
+	}
+	return po.order[i]
+}
+
+// nrgbaImageLSBReaderWriter reads and writes a bit stream in the low bits of
+// the pixels of m, pixel by pixel, channel by channel (red, green, blue and
+// maybe alpha), lowest bit first. Pixels are visited row by row unless a key
+// scatters them. It works on m.Pix directly.
 type nrgbaImageLSBReaderWriter struct {
 	m       *image.NRGBA
-	x, y, q int
+	layout  lsbLayout
+	order   *pixelOrder
+	npixels int
+
+	// position of the next bit
+	pixel, channel, bit int
+
+	// offset of pixel in m.Pix, valid if offsetPixel == pixel
+	offset, offsetPixel int
 }
 
 func newNRGBAImageLSBReaderWriter(im image.Image) *nrgbaImageLSBReaderWriter {
 	rv := new(nrgbaImageLSBReaderWriter)
 
-	rv.x = 0
-	rv.y = 0
-	rv.q = -1
-
 	b := im.Bounds()
 
 	rv.m = image.NewNRGBA(image.Rect(0, 0, b.Max.X-b.Min.X, b.Max.Y-b.Min.Y))
+	rv.npixels = b.Dx() * b.Dy()
 
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			rv.m.Set(x-b.Min.X, y-b.Min.Y, im.At(x, y))
+	if src, ok := im.(*image.NRGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := src.PixOffset(b.Min.X, y)
+			copy(rv.m.Pix[(y-b.Min.Y)*rv.m.Stride:], src.Pix[i:i+4*b.Dx()])
+		}
+	} else {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				rv.m.Set(x-b.Min.X, y-b.Min.Y, im.At(x, y))
+			}
 		}
 	}
+
+	rv.reset()
 	return rv
 }
 
+// setKey scatters the pixels in an order derived from key. An empty key
+// visits them row by row.
+func (it *nrgbaImageLSBReaderWriter) setKey(key []byte) {
+	if len(key) == 0 {
+		it.order = nil
+	} else {
+		it.order = newPixelOrder(key, it.npixels)
+	}
+	it.offsetPixel = -1
+}
+
+func (it *nrgbaImageLSBReaderWriter) seek() {
+	i := it.pixel
+	if it.order != nil {
+		i = it.order.pixel(i)
+	}
+	width := it.m.Rect.Dx()
+	it.offset = (i/width)*it.m.Stride + (i%width)*4
+	it.offsetPixel = it.pixel
+}
+
 func (it *nrgbaImageLSBReaderWriter) reset() {
-	it.x = 0
-	it.y = 0
-	it.q = -1
+	if it.order != nil {
+		it.order.reset()
+	}
+	it.layout = defaultLayout
+	it.pixel = 0
+	it.channel = 0
+	it.bit = 0
+	it.offsetPixel = -1
+}
+
+// setLayout switches to layout l, starting at the next whole pixel.
+func (it *nrgbaImageLSBReaderWriter) setLayout(l lsbLayout) error {
+	if it.channel != 0 || it.bit != 0 {
+		it.pixel++
+		it.channel = 0
+		it.bit = 0
+	}
+	it.layout = l
+	return nil
+}
+
+// Len returns the number of whole bytes left.
+func (it *nrgbaImageLSBReaderWriter) Len() int {
+	bitsPerPixel := it.layout.channels() * it.layout.bits
+	rv := (it.npixels-it.pixel)*bitsPerPixel - it.channel*it.layout.bits - it.bit
+	if rv < 0 {
+		return 0
+	}
+	return rv / 8
+}
+
+func (it *nrgbaImageLSBReaderWriter) advance() {
+	it.bit++
+	if it.bit == it.layout.bits {
+		it.bit = 0
+		it.channel++
+		if it.channel == it.layout.channels() {
+			it.channel = 0
+			it.pixel++
+		}
+	}
 }
 
 func (it *nrgbaImageLSBReaderWriter) Read(p []byte) (n int, err error) {
-	n = 0
-	for j, _ := range p {
-		var rv byte = 0
-		var i uint8
-		for i = 0; i < 8; i++ {
-			it.q++
-			if it.q == 3 {
-				it.q = 0
-				it.x++
-				if it.x == it.m.Rect.Max.X {
-					it.x = it.m.Rect.Min.X
-					it.y++
-					if it.y == it.m.Rect.Max.Y {
-						return n, io.EOF
-					}
-				}
+	pix := it.m.Pix
+	for j := range p {
+		var rv byte
+		for i := uint(0); i < 8; i++ {
+			if it.pixel >= it.npixels {
+				return n, io.EOF
 			}
-
-			color := it.m.At(it.x, it.y).(color.NRGBA)
-			var colorByte byte
-			switch it.q {
-			case 0:
-				colorByte = color.R
-			case 1:
-				colorByte = color.G
-			case 2:
-				colorByte = color.B
+			if it.offsetPixel != it.pixel {
+				it.seek()
 			}
-			rv = rv | ((colorByte & 1) << i)
+
+			rv |= ((pix[it.offset+it.channel] >> uint(it.bit)) & 1) << i
+
+			it.advance()
 		}
 		p[j] = rv
 		n++
@@ -125,44 +642,22 @@ func (it *nrgbaImageLSBReaderWriter) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-func setLSB(val, bit byte) byte {
-	var rv byte
-	if bit == 1 {
-		rv = val | 1
-	} else {
-		rv = val & 0xfe
-	}
-	return rv
-}
-
 func (it *nrgbaImageLSBReaderWriter) Write(p []byte) (n int, err error) {
-	n = 0
+	pix := it.m.Pix
 	for _, v := range p {
-		var i uint8
-		for i = 0; i < 8; i++ {
-			it.q++
-			if it.q == 3 {
-				it.q = 0
-				it.x++
-				if it.x == it.m.Rect.Max.X {
-					it.x = it.m.Rect.Min.X
-					it.y++
-					if it.y == it.m.Rect.Max.Y {
-						return n, io.EOF
-					}
-				}
+		for i := uint(0); i < 8; i++ {
+			if it.pixel >= it.npixels {
+				return n, io.EOF
 			}
-
-			color := it.m.At(it.x, it.y).(color.NRGBA)
-			switch it.q {
-			case 0:
-				color.R = setLSB(color.R, (v>>i)&1)
-			case 1:
-				color.G = setLSB(color.G, (v>>i)&1)
-			case 2:
-				color.B = setLSB(color.B, (v>>i)&1)
+			if it.offsetPixel != it.pixel {
+				it.seek()
 			}
-			it.m.Set(it.x, it.y, color)
+
+			o := it.offset + it.channel
+			mask := byte(1) << uint(it.bit)
+			pix[o] = pix[o]&^mask | ((v>>i)&1)<<uint(it.bit)
+
+			it.advance()
 		}
 		n++
 	}
@@ -30,8 +30,16 @@ package kindi
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
 	"io"
 	"image/jpeg"
+	"image/png"
 	"testing"
 	"os"
 )
@@ -150,3 +158,640 @@ func TestEmbed(t *testing.T) {
 	}
 
 }
+
+func TestIdenticon(t *testing.T) {
+	a, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+	b, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+
+	payload := make([]byte, 40000)
+	rand.Read(payload)
+
+	ma, err := newIdenticon(&a.PublicKey, len(payload))
+	if err != nil {
+		t.Fatalf("failed to draw identicon %v", err)
+	}
+	mb, err := newIdenticon(&b.PublicKey, len(payload))
+	if err != nil {
+		t.Fatalf("failed to draw identicon %v", err)
+	}
+
+	if bytes.Equal(ma.Pix, mb.Pix) {
+		t.Fatalf("identicons of different keys are identical")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	err = EncodePNG(buf, payload, ma)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+
+	outpayload, err := DecodePNG(buf)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+
+	if !bytes.Equal(outpayload, payload) {
+		t.Fatalf("decoded payload different from original payload")
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+
+	capacity := Capacity(m)
+	// 16 pixels for the frame preamble, 10 bytes for item count, header and checksum
+	if capacity != (10*10-16)*3/8-10 {
+		t.Fatalf("unexpected capacity %d", capacity)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	err := EncodePNG(buf, make([]byte, capacity), m)
+	if err != nil {
+		t.Fatalf("failed to encode payload of exactly capacity %v", err)
+	}
+
+	buf.Reset()
+	err = EncodePNG(buf, make([]byte, capacity+1), m)
+	if !errors.Is(err, ErrImageTooSmall) {
+		t.Fatalf("expected ErrImageTooSmall, got %v", err)
+	}
+
+	payload := make([]byte, 500)
+	rand.Read(payload)
+
+	fitted, err := fitImage(m, len(payload), pngCarrier, nil)
+	if err != nil {
+		t.Fatalf("failed to fit image %v", err)
+	}
+	if Capacity(fitted) < len(payload) {
+		t.Fatalf("fitted image holds %d bytes, need %d", Capacity(fitted), len(payload))
+	}
+
+	buf.Reset()
+	err = EncodePNG(buf, payload, fitted)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+
+	outpayload, err := DecodePNG(buf)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+
+	if !bytes.Equal(outpayload, payload) {
+		t.Fatalf("decoded payload different from original payload")
+	}
+}
+
+func TestDecodeNoPayload(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	err := png.Encode(buf, m)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+
+	_, err = DecodePNG(buf)
+	if !errors.Is(err, ErrNoPayload) {
+		t.Fatalf("expected ErrNoPayload, got %v", err)
+	}
+
+	payload := make([]byte, 1000)
+	buf.Reset()
+	err = EncodePNG(buf, payload, m)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+
+	decoded, err := png.Decode(buf)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+
+	_, _, err = decodeImage(decoded, len(payload)-1)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge for payload above maximum, got %v", err)
+	}
+}
+
+func TestPayloadItems(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+
+	items := []PayloadItem{
+		{Type: PayloadCertificate, Data: []byte("certificate")},
+		{Type: PayloadRevocation, Data: []byte("revocation")},
+		{Type: PayloadProfile, Data: []byte{}},
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	err := EncodeItemsPNG(buf, items, m, nil)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+	encoded := buf.Bytes()
+
+	outitems, err := DecodeItemsPNG(bytes.NewReader(encoded), nil)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+	if len(outitems) != len(items) {
+		t.Fatalf("expected %d items, got %d", len(items), len(outitems))
+	}
+	for i := range items {
+		if outitems[i].Type != items[i].Type || !bytes.Equal(outitems[i].Data, items[i].Data) {
+			t.Fatalf("item %d different from original item", i)
+		}
+	}
+
+	// flip the least significant bit carrying the first bit of the first item's data
+	decoded, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+	damaged := newNRGBAImageLSBReaderWriter(decoded).m
+	bit := 8 * (frameHeaderSize + frameItemHeaderSize)
+	damaged.Pix[(bit/3)*4+bit%3] ^= 1
+
+	_, _, err = decodeItems(damaged, MaxPayloadSize, nil)
+	if !errors.Is(err, ErrPayloadCorrupt) {
+		t.Fatalf("expected ErrPayloadCorrupt, got %v", err)
+	}
+}
+
+func TestLegacyPayload(t *testing.T) {
+	payload := []byte("certificate embedded by an older kindi")
+
+	lsbim := newNRGBAImageLSBReaderWriter(image.NewNRGBA(image.Rect(0, 0, 100, 100)))
+	err := writeLengthEncoded(lsbim, payload)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+
+	outpayload, _, err := decodeImage(lsbim.m, MaxPayloadSize)
+	if err != nil {
+		t.Fatalf("failed to decode legacy payload %v", err)
+	}
+	if !bytes.Equal(outpayload, payload) {
+		t.Fatalf("decoded payload different from original payload")
+	}
+}
+
+func TestFrameVersion1(t *testing.T) {
+	data := []byte("certificate framed by kindi before layouts")
+
+	// version 1 frames have no layout byte, the item count follows the
+	// version right away, in the middle of a pixel
+	frame := bytes.NewBuffer(nil)
+	frame.Write(frameMagic)
+	frame.WriteByte(1)
+	frame.WriteByte(1)
+	item := frame.Len()
+	frame.WriteByte(byte(PayloadCertificate))
+	binary.Write(frame, binary.BigEndian, uint32(len(data)))
+	frame.Write(data)
+	binary.Write(frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()[item:]))
+
+	lsbim := newNRGBAImageLSBReaderWriter(image.NewNRGBA(image.Rect(0, 0, 100, 100)))
+	_, err := lsbim.Write(frame.Bytes())
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+
+	items, _, err := decodeItems(lsbim.m, MaxPayloadSize, nil)
+	if err != nil {
+		t.Fatalf("failed to decode version 1 frame %v", err)
+	}
+	if len(items) != 1 || items[0].Type != PayloadCertificate || !bytes.Equal(items[0].Data, data) {
+		t.Fatalf("decoded items different from original items")
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	rand.Read(m.Pix)
+	for i := 3; i < len(m.Pix); i += 4 {
+		m.Pix[i] = 0xff
+	}
+
+	previous := 0
+	for _, alpha := range []bool{false, true} {
+		for bits := 1; bits <= 4; bits++ {
+			opts := &StegoOptions{BitsPerChannel: bits, Alpha: alpha}
+
+			capacity, err := CapacityWithOptions(m, opts)
+			if err != nil {
+				t.Fatalf("%d bits, alpha %v: %v", bits, alpha, err)
+			}
+			if !alpha && capacity <= previous {
+				t.Fatalf("%d bits: capacity %d not bigger than with fewer bits", bits, capacity)
+			}
+			previous = capacity
+
+			payload := make([]byte, capacity)
+			rand.Read(payload)
+
+			buf := bytes.NewBuffer(make([]byte, 0, 1024))
+			err = EncodeItemsPNG(buf, []PayloadItem{{Type: PayloadCertificate, Data: payload}}, m, opts)
+			if err != nil {
+				t.Fatalf("%d bits, alpha %v: failed to encode as PNG %v", bits, alpha, err)
+			}
+
+			outpayload, err := DecodePNG(buf)
+			if err != nil {
+				t.Fatalf("%d bits, alpha %v: failed to decode PNG %v", bits, alpha, err)
+			}
+			if !bytes.Equal(outpayload, payload) {
+				t.Fatalf("%d bits, alpha %v: decoded payload different from original payload", bits, alpha)
+			}
+
+			buf.Reset()
+			err = EncodeItemsPNG(buf, []PayloadItem{{Type: PayloadCertificate, Data: make([]byte, capacity+1)}}, m, opts)
+			if !errors.Is(err, ErrImageTooSmall) {
+				t.Fatalf("%d bits, alpha %v: expected ErrImageTooSmall, got %v", bits, alpha, err)
+			}
+		}
+	}
+
+	_, err := CapacityWithOptions(m, &StegoOptions{BitsPerChannel: 5})
+	if err == nil {
+		t.Fatalf("expected error for 5 bits per channel")
+	}
+}
+
+func TestScattered(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+
+	payload := make([]byte, 300)
+	rand.Read(payload)
+
+	opts := &StegoOptions{Key: []byte("foo@gmail.com")}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	err := EncodeItemsPNG(buf, []PayloadItem{{Type: PayloadCertificate, Data: payload}}, m, opts)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+	encoded := buf.Bytes()
+
+	decoded, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+
+	// the payload only needs the first ~900 pixels, scattered it must reach the bottom half
+	lsbim := newNRGBAImageLSBReaderWriter(decoded)
+	touched := 0
+	for i := len(lsbim.m.Pix) / 2; i < len(lsbim.m.Pix); i++ {
+		if lsbim.m.Pix[i] != 0 && i%4 != 3 {
+			touched++
+		}
+	}
+	if touched == 0 {
+		t.Fatalf("scattered payload didn't touch the bottom half of the image")
+	}
+
+	items, err := DecodeItemsPNG(bytes.NewReader(encoded), opts)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+	if len(items) != 1 || !bytes.Equal(items[0].Data, payload) {
+		t.Fatalf("decoded payload different from original payload")
+	}
+
+	_, err = DecodeItemsPNG(bytes.NewReader(encoded), &StegoOptions{Key: []byte("bar@gmail.com")})
+	if !errors.Is(err, ErrNoPayload) {
+		t.Fatalf("expected ErrNoPayload with the wrong key, got %v", err)
+	}
+
+	_, err = DecodePNG(bytes.NewReader(encoded))
+	if !errors.Is(err, ErrNoPayload) {
+		t.Fatalf("expected ErrNoPayload without key, got %v", err)
+	}
+}
+
+func TestErrorCorrection(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+
+	cert := make([]byte, 1000)
+	rand.Read(cert)
+
+	opts := &StegoOptions{Redundancy: 16}
+	capacity, err := CapacityWithOptions(m, opts)
+	if err != nil {
+		t.Fatalf("failed to compute capacity %v", err)
+	}
+	if capacity >= Capacity(m) || capacity < len(cert) {
+		t.Fatalf("unexpected capacity %d with redundancy, %d without", capacity, Capacity(m))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = EncodeItemsPNG(buf, []PayloadItem{{Type: PayloadCertificate, Data: cert}}, m, opts)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+
+	decoded, err := png.Decode(buf)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+	damaged := newNRGBAImageLSBReaderWriter(decoded).m
+
+	// flip one bit in each of 20 bytes after the preamble, spread so no
+	// codeword gets more than it can repair
+	for i := 0; i < 20; i++ {
+		bit := 8 * (framePreambleSize + 20 + i*50)
+		damaged.Pix[(bit/3)*4+bit%3] ^= 1
+	}
+
+	outcert, corrected, err := decodeImage(damaged, MaxPayloadSize)
+	if err != nil {
+		t.Fatalf("failed to decode damaged image %v", err)
+	}
+	if corrected != 20 {
+		t.Fatalf("expected 20 corrections, got %d", corrected)
+	}
+	if !bytes.Equal(outcert, cert) {
+		t.Fatalf("decoded certificate different from original certificate")
+	}
+
+	// without redundancy the same damage is fatal
+	buf.Reset()
+	err = EncodePNG(buf, cert, m)
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+	decoded, err = png.Decode(buf)
+	if err != nil {
+		t.Fatalf("failed to decode PNG %v", err)
+	}
+	damaged = newNRGBAImageLSBReaderWriter(decoded).m
+	for i := 0; i < 20; i++ {
+		bit := 8 * (framePreambleSize + 20 + i*50)
+		damaged.Pix[(bit/3)*4+bit%3] ^= 1
+	}
+	_, _, err = decodeImage(damaged, MaxPayloadSize)
+	if !errors.Is(err, ErrPayloadCorrupt) {
+		t.Fatalf("expected ErrPayloadCorrupt, got %v", err)
+	}
+
+	err = EncodeItemsPNG(buf, nil, m, &StegoOptions{Redundancy: 12})
+	if err == nil {
+		t.Fatalf("expected redundancy that isn't a multiple of 8 to fail")
+	}
+}
+
+func TestJPEG(t *testing.T) {
+	r, err := os.Open("./testdata/uwe.jpeg")
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	defer r.Close()
+
+	m, err := jpeg.Decode(r)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+
+	// large enough to need more than one APP11 segment
+	cert := make([]byte, 100000)
+	rand.Read(cert)
+	items := []PayloadItem{
+		{Type: PayloadCertificate, Data: cert},
+		{Type: PayloadProfile, Data: []byte("profile")},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = EncodeItemsJPEG(buf, items, m)
+	if err != nil {
+		t.Fatalf("failed to encode as JPEG %v", err)
+	}
+	encoded := buf.Bytes()
+
+	// still a valid JPEG for everybody else
+	_, err = jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to decode JPEG %v", err)
+	}
+
+	outitems, err := DecodeItemsJPEG(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to decode JPEG items %v", err)
+	}
+	if len(outitems) != len(items) {
+		t.Fatalf("expected %d items, got %d", len(items), len(outitems))
+	}
+	for i := range items {
+		if outitems[i].Type != items[i].Type || !bytes.Equal(outitems[i].Data, items[i].Data) {
+			t.Fatalf("item %d different from original item", i)
+		}
+	}
+
+	outcert, _, err := decodeCertImage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to decode certificate from JPEG %v", err)
+	}
+	if !bytes.Equal(outcert, cert) {
+		t.Fatalf("decoded certificate different from original certificate")
+	}
+
+	// a plain JPEG carries nothing
+	plain := bytes.NewBuffer(nil)
+	jpeg.Encode(plain, m, nil)
+	_, err = DecodeItemsJPEG(plain)
+	if !errors.Is(err, ErrNoPayload) {
+		t.Fatalf("expected ErrNoPayload, got %v", err)
+	}
+}
+
+func TestDecodeCertImage(t *testing.T) {
+	cert := []byte("certificate")
+
+	buf := bytes.NewBuffer(nil)
+	err := EncodePNG(buf, cert, image.NewNRGBA(image.Rect(0, 0, 100, 100)))
+	if err != nil {
+		t.Fatalf("failed to encode as PNG %v", err)
+	}
+
+	outcert, _, err := decodeCertImage(buf)
+	if err != nil {
+		t.Fatalf("failed to decode certificate from PNG %v", err)
+	}
+	if !bytes.Equal(outcert, cert) {
+		t.Fatalf("decoded certificate different from original certificate")
+	}
+
+	_, _, err = decodeCertImage(bytes.NewReader([]byte("not an image")))
+	if !errors.Is(err, ErrNoPayload) {
+		t.Fatalf("expected ErrNoPayload, got %v", err)
+	}
+}
+
+// referenceLSBReaderWriter is the original implementation going through
+// At and Set for every bit, one low bit of red, green and blue. It serves as
+// oracle for the Pix based one and as baseline for the benchmarks.
+type referenceLSBReaderWriter struct {
+	m       *image.NRGBA
+	x, y, q int
+}
+
+func newReferenceLSBReaderWriter(im image.Image) *referenceLSBReaderWriter {
+	rv := new(referenceLSBReaderWriter)
+	rv.q = -1
+
+	b := im.Bounds()
+
+	rv.m = image.NewNRGBA(image.Rect(0, 0, b.Max.X-b.Min.X, b.Max.Y-b.Min.Y))
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			rv.m.Set(x-b.Min.X, y-b.Min.Y, im.At(x, y))
+		}
+	}
+	return rv
+}
+
+func (it *referenceLSBReaderWriter) next() bool {
+	it.q++
+	if it.q == 3 {
+		it.q = 0
+		it.x++
+		if it.x == it.m.Rect.Max.X {
+			it.x = it.m.Rect.Min.X
+			it.y++
+			if it.y == it.m.Rect.Max.Y {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (it *referenceLSBReaderWriter) Read(p []byte) (n int, err error) {
+	for j := range p {
+		var rv byte
+		for i := uint(0); i < 8; i++ {
+			if !it.next() {
+				return n, io.EOF
+			}
+			c := it.m.At(it.x, it.y).(color.NRGBA)
+			v := [3]byte{c.R, c.G, c.B}[it.q]
+			rv |= (v & 1) << i
+		}
+		p[j] = rv
+		n++
+	}
+	return n, nil
+}
+
+func (it *referenceLSBReaderWriter) Write(p []byte) (n int, err error) {
+	for _, v := range p {
+		for i := uint(0); i < 8; i++ {
+			if !it.next() {
+				return n, io.EOF
+			}
+			c := it.m.At(it.x, it.y).(color.NRGBA)
+			bit := (v >> i) & 1
+			switch it.q {
+			case 0:
+				c.R = c.R&0xfe | bit
+			case 1:
+				c.G = c.G&0xfe | bit
+			case 2:
+				c.B = c.B&0xfe | bit
+			}
+			it.m.Set(it.x, it.y, c)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func TestMatchesReference(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(3, 5, 80, 61))
+	rand.Read(m.Pix)
+
+	payload := make([]byte, Capacity(m))
+	rand.Read(payload)
+
+	fast := newNRGBAImageLSBReaderWriter(m)
+	ref := newReferenceLSBReaderWriter(m)
+
+	_, err := fast.Write(payload)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	_, err = ref.Write(payload)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+
+	if !bytes.Equal(fast.m.Pix, ref.m.Pix) {
+		t.Fatalf("fast and reference writer produced different pixels")
+	}
+
+	ref = newReferenceLSBReaderWriter(fast.m)
+	outpayload := make([]byte, len(payload))
+	_, err = io.ReadFull(ref, outpayload)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	if !bytes.Equal(outpayload, payload) {
+		t.Fatalf("reference reader read different payload")
+	}
+}
+
+const benchmarkSide = 2048
+
+func benchmarkImage() (*image.NRGBA, []byte) {
+	m := image.NewNRGBA(image.Rect(0, 0, benchmarkSide, benchmarkSide))
+	rand.Read(m.Pix)
+	payload := make([]byte, benchmarkSide*benchmarkSide*3/8)
+	rand.Read(payload)
+	return m, payload
+}
+
+func BenchmarkLSBWriteReference(b *testing.B) {
+	m, payload := benchmarkImage()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newReferenceLSBReaderWriter(m).Write(payload)
+	}
+}
+
+func BenchmarkLSBWrite(b *testing.B) {
+	m, payload := benchmarkImage()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newNRGBAImageLSBReaderWriter(m).Write(payload)
+	}
+}
+
+func BenchmarkLSBReadReference(b *testing.B) {
+	m, payload := benchmarkImage()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newReferenceLSBReaderWriter(m).Read(payload)
+	}
+}
+
+func BenchmarkLSBRead(b *testing.B) {
+	m, payload := benchmarkImage()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newNRGBAImageLSBReaderWriter(m).Read(payload)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// carrier is an image format frames can be embedded into and extracted from.
+type carrier interface {
+	// name is the short name of the format, like "png".
+	name() string
+
+	// extensions are the lower case file extensions of the format, the
+	// first one is used for new files.
+	extensions() []string
+
+	// match reports whether header, the first bytes of a file, belong to
+	// an image in this format.
+	match(header []byte) bool
+
+	// capacity returns the number of bytes a single item embedded into an
+	// image with bounds b can have.
+	capacity(b image.Rectangle, opts *StegoOptions) (int, error)
+
+	encode(w io.Writer, items []PayloadItem, m image.Image, opts *StegoOptions) error
+	decode(r io.Reader, key []byte, maxSize int) ([]PayloadItem, int, error)
+}
+
+// lsbCarrier embeds frames into the low bits of the pixels of a lossless
+// format.
+type lsbCarrier struct {
+	format      string
+	exts        []string
+	noAlpha     bool // alpha doesn't survive encoding and decoding
+	magic       func(header []byte) bool
+	encodeImage func(w io.Writer, m image.Image) error
+	decodeImage func(r io.Reader) (image.Image, error)
+}
+
+func (c *lsbCarrier) name() string             { return c.format }
+func (c *lsbCarrier) extensions() []string     { return c.exts }
+func (c *lsbCarrier) match(header []byte) bool { return c.magic(header) }
+
+func (c *lsbCarrier) capacity(b image.Rectangle, opts *StegoOptions) (int, error) {
+	l, err := opts.layout()
+	if err != nil {
+		return 0, err
+	}
+	if l.alpha && c.noAlpha {
+		return 0, fmt.Errorf("%s carriers don't keep alpha, can't use %v", c.format, l)
+	}
+	parity, err := opts.parity()
+	if err != nil {
+		return 0, err
+	}
+	return capacityOf(b, l, parity), nil
+}
+
+func (c *lsbCarrier) encode(w io.Writer, items []PayloadItem, m image.Image, opts *StegoOptions) error {
+	_, err := c.capacity(m.Bounds(), opts)
+	if err != nil {
+		return err
+	}
+
+	nrgba, err := embedItems(items, m, opts)
+	if err != nil {
+		return err
+	}
+	return c.encodeImage(w, nrgba)
+}
+
+func (c *lsbCarrier) decode(r io.Reader, key []byte, maxSize int) ([]PayloadItem, int, error) {
+	m, err := c.decodeImage(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeItems(m, maxSize, key)
+}
+
+func hasPrefix(prefixes ...string) func(header []byte) bool {
+	return func(header []byte) bool {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(header, []byte(prefix)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var pngCarrier = &lsbCarrier{
+	format:      "png",
+	exts:        []string{".png"},
+	magic:       hasPrefix("\x89PNG\r\n\x1a\n"),
+	encodeImage: png.Encode,
+	decodeImage: decodePNG,
+}
+
+var bmpCarrier = &lsbCarrier{
+	format:      "bmp",
+	exts:        []string{".bmp"},
+	noAlpha:     true,
+	magic:       hasPrefix("BM"),
+	encodeImage: bmp.Encode,
+	decodeImage: limitedDecoder(bmp.DecodeConfig, bmp.Decode),
+}
+
+var tiffCarrier = &lsbCarrier{
+	format: "tiff",
+	exts:   []string{".tiff", ".tif"},
+	magic:  hasPrefix("II*\x00", "MM\x00*"),
+	encodeImage: func(w io.Writer, m image.Image) error {
+		return tiff.Encode(w, m, &tiff.Options{Compression: tiff.Deflate})
+	},
+	decodeImage: limitedDecoder(tiff.DecodeConfig, tiff.Decode),
+}
+
+// Only lossless WebP keeps low bits. golang.org/x/image/webp decodes both
+// kinds, encodeWebPLossless writes the lossless one.
+var webpCarrier = &lsbCarrier{
+	format: "webp",
+	exts:   []string{".webp"},
+	magic: func(header []byte) bool {
+		return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP"
+	},
+	encodeImage: encodeWebPLossless,
+	decodeImage: limitedDecoder(webp.DecodeConfig, webp.Decode),
+}
+
+// carriers lists all supported formats, the first is the default.
+var carriers = []carrier{pngCarrier, jpegCarrier{}, gifCarrier{}, bmpCarrier, tiffCarrier, webpCarrier}
+
+// CarrierFormats returns the names of the image formats payloads can be
+// embedded into.
+func CarrierFormats() []string {
+	rv := make([]string, len(carriers))
+	for i, c := range carriers {
+		rv[i] = c.name()
+	}
+	return rv
+}
+
+func carrierByName(name string) (carrier, error) {
+	for _, c := range carriers {
+		if c.name() == strings.ToLower(name) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown carrier format %q, supported are %s", name, strings.Join(CarrierFormats(), ", "))
+}
+
+// carrierForPath returns the carrier for the extension of path, PNG if the
+// extension is unknown.
+func carrierForPath(path string) carrier {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, c := range carriers {
+		for _, e := range c.extensions() {
+			if e == ext {
+				return c
+			}
+		}
+	}
+	return pngCarrier
+}
+
+// decodeCarrier extracts the items embedded in the image read from r, in
+// whatever supported format it is.
+func decodeCarrier(r io.Reader, key []byte, maxSize int) ([]PayloadItem, int, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(16)
+
+	for _, c := range carriers {
+		if c.match(header) {
+			return c.decode(br, key, maxSize)
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: unsupported image format", ErrNoPayload)
+}
+
+// decodeCertImage returns the certificate embedded in the image read from
+// rin, in whatever supported format it is, and the number of bytes error
+// correction repaired.
+func decodeCertImage(rin io.Reader) ([]byte, int, error) {
+	items, corrected, err := decodeCarrier(rin, nil, MaxPayloadSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cert, err := certificateItem(items)
+	return cert, corrected, err
+}
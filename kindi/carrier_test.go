@@ -0,0 +1,276 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func testCarrierImage(t *testing.T) image.Image {
+	r, err := os.Open("./testdata/uwe.jpeg")
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	defer r.Close()
+
+	m, err := jpeg.Decode(r)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	return m
+}
+
+func TestCarriers(t *testing.T) {
+	m := testCarrierImage(t)
+
+	data := make([]byte, 500)
+	rand.Read(data)
+	items := []PayloadItem{
+		{Type: PayloadCertificate, Data: data},
+		{Type: PayloadProfile, Data: []byte("profile")},
+	}
+
+	optionSets := []*StegoOptions{
+		nil,
+		{Key: []byte("bob@gmail.com"), Redundancy: 16},
+		{BitsPerChannel: 2, Alpha: true},
+	}
+
+	for _, c := range carriers {
+		for _, opts := range optionSets {
+			_, err := c.capacity(m.Bounds(), opts)
+			if err != nil {
+				// not every carrier supports every option
+				continue
+			}
+
+			buf := bytes.NewBuffer(nil)
+			err = c.encode(buf, items, m, opts)
+			if err != nil {
+				t.Fatalf("%s: failed to encode with %+v: %v", c.name(), opts, err)
+			}
+
+			outitems, _, err := decodeCarrier(bytes.NewReader(buf.Bytes()), opts.key(), MaxPayloadSize)
+			if err != nil {
+				t.Fatalf("%s: failed to decode with %+v: %v", c.name(), opts, err)
+			}
+			if len(outitems) != len(items) {
+				t.Fatalf("%s: expected %d items, got %d", c.name(), len(items), len(outitems))
+			}
+			for i := range items {
+				if outitems[i].Type != items[i].Type || !bytes.Equal(outitems[i].Data, items[i].Data) {
+					t.Fatalf("%s: item %d different from original item", c.name(), i)
+				}
+			}
+		}
+	}
+}
+
+func TestCarrierForPath(t *testing.T) {
+	paths := map[string]string{
+		"me.png":   "png",
+		"me.JPG":   "jpeg",
+		"me.jpeg":  "jpeg",
+		"me.gif":   "gif",
+		"me.bmp":   "bmp",
+		"me.tif":   "tiff",
+		"me.webp":  "webp",
+		"me":       "png",
+		"me.kindi": "png",
+	}
+	for path, name := range paths {
+		if c := carrierForPath(path); c.name() != name {
+			t.Fatalf("expected %s for %s, got %s", name, path, c.name())
+		}
+	}
+
+	_, err := carrierByName("xcf")
+	if err == nil {
+		t.Fatalf("expected unknown carrier format to fail")
+	}
+}
+
+func TestWebPLossless(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 33, 17))
+	rand.Read(m.Pix)
+
+	buf := bytes.NewBuffer(nil)
+	err := encodeWebPLossless(buf, m)
+	if err != nil {
+		t.Fatalf("failed to encode WebP %v", err)
+	}
+
+	decoded, err := webp.Decode(buf)
+	if err != nil {
+		t.Fatalf("failed to decode WebP %v", err)
+	}
+	nrgba, ok := decoded.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("expected *image.NRGBA, got %T", decoded)
+	}
+	if !nrgba.Rect.Eq(m.Rect) || !bytes.Equal(nrgba.Pix, m.Pix) {
+		t.Fatalf("decoded WebP different from original image")
+	}
+}
+
+func TestGIFKeepsSmallPalette(t *testing.T) {
+	palette := color.Palette{
+		color.NRGBA{0xff, 0, 0, 0xff},
+		color.NRGBA{0, 0xff, 0, 0xff},
+		color.NRGBA{0, 0, 0xff, 0xff},
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 100, 100), palette)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i % len(palette))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := gifCarrier{}.encode(buf, []PayloadItem{{Type: PayloadCertificate, Data: []byte("certificate")}}, m, nil)
+	if err != nil {
+		t.Fatalf("failed to encode GIF %v", err)
+	}
+
+	decoded, err := gif.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode GIF %v", err)
+	}
+	for i := range m.Pix {
+		x, y := i%100, i/100
+		want := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+		got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+		if got.R != want.R || got.G != want.G || got.B&^1 != want.B&^1 {
+			t.Fatalf("pixel %d,%d changed from %v to %v", x, y, want, got)
+		}
+	}
+
+	cert, _, err := decodeCertImage(buf)
+	if err != nil || string(cert) != "certificate" {
+		t.Fatalf("failed to decode certificate from GIF: %q, %v", cert, err)
+	}
+
+	_, err = gifCarrier{}.capacity(m.Bounds(), &StegoOptions{BitsPerChannel: 2})
+	if err == nil {
+		t.Fatalf("expected GIF carrier to refuse 2 bits per channel")
+	}
+	err = gifCarrier{}.encode(buf, []PayloadItem{{Type: PayloadCertificate, Data: make([]byte, 2000)}}, m, nil)
+	if !errors.Is(err, ErrImageTooSmall) {
+		t.Fatalf("expected ErrImageTooSmall, got %v", err)
+	}
+}
+
+func TestCarriersTooLarge(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+
+	// each patch makes the header claim more than MaxImagePixels pixels,
+	// decoding them would allocate gigabytes
+	tests := []struct {
+		encode func(w io.Writer, m image.Image) error
+		patch  func(data []byte)
+	}{
+		{bmpCarrier.encodeImage, func(data []byte) {
+			binary.LittleEndian.PutUint32(data[18:], 10000)
+			binary.LittleEndian.PutUint32(data[22:], 10000)
+		}},
+		{func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) }, func(data []byte) {
+			binary.LittleEndian.PutUint16(data[6:], 0xffff)
+			binary.LittleEndian.PutUint16(data[8:], 0xffff)
+		}},
+		{tiffCarrier.encodeImage, func(data []byte) {
+			ifd := binary.LittleEndian.Uint32(data[4:])
+			n := int(binary.LittleEndian.Uint16(data[ifd:]))
+			for i := 0; i < n; i++ {
+				entry := data[int(ifd)+2+12*i:]
+				tag := binary.LittleEndian.Uint16(entry)
+				if tag == 256 || tag == 257 { // ImageWidth, ImageLength
+					binary.LittleEndian.PutUint16(entry[2:], 4) // LONG
+					binary.LittleEndian.PutUint32(entry[8:], 100000)
+				}
+			}
+		}},
+		{webpCarrier.encodeImage, func(data []byte) {
+			// VP8L: 14 bits width-1 and 14 bits height-1 after the signature
+			const max = 1<<14 - 1
+			v := binary.LittleEndian.Uint32(data[21:])
+			v = v&^(max<<14|max) | max<<14 | max
+			binary.LittleEndian.PutUint32(data[21:], v)
+		}},
+	}
+
+	for i, test := range tests {
+		buf := new(bytes.Buffer)
+		err := test.encode(buf, m)
+		if err != nil {
+			t.Fatalf("%d: failed to encode %v", i, err)
+		}
+		data := buf.Bytes()
+		test.patch(data)
+
+		_, _, err = decodeCertImage(bytes.NewReader(data))
+		if !errors.Is(err, ErrImageTooLarge) {
+			t.Fatalf("%d: expected ErrImageTooLarge, got %v", i, err)
+		}
+	}
+}
+
+func TestCarrierEncodedSizeLimit(t *testing.T) {
+	saved := MaxImagePixels
+	defer func() { MaxImagePixels = saved }()
+	MaxImagePixels = 100
+
+	buf := new(bytes.Buffer)
+	err := bmpCarrier.encodeImage(buf, image.NewNRGBA(image.Rect(0, 0, 10, 10)))
+	if err != nil {
+		t.Fatalf("failed to encode %v", err)
+	}
+
+	_, err = bmpCarrier.decodeImage(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode %v", err)
+	}
+
+	// a small image followed by more data than any image of MaxImagePixels
+	// pixels needs isn't read into memory
+	buf.Write(make([]byte, maxEncodedImageSize()))
+	_, err = bmpCarrier.decodeImage(buf)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("expected ErrImageTooLarge, got %v", err)
+	}
+}
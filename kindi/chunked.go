@@ -0,0 +1,717 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Chunked .kindi files start with fileMagic and the version byte, followed
+// by a header and header hmac like version 1 files. kindi writes version 4
+// for recipient keys and version 3 for passphrases, and still reads version
+// 2, which has a single wrapped key. The encrypted header fields end with
+// the body parameters and metadata. From version 3 on the header hmac also
+// covers the magic, the version byte and the recipients or key derivation
+// parameters, see authenticatedPrefix. The body is a sequence of chunks and
+// a trailer:
+//
+//	chunk:   plaintext length (4 bytes, top bit set for the last chunk), AES-256-GCM ciphertext
+//	trailer: AES-256-GCM ciphertext of plaintext length (8 bytes), chunk count (8 bytes), chunk size (4 bytes)
+//
+// Every chunk but the last holds exactly chunk size plaintext bytes, so the
+// offset of any chunk follows from its index; the layout is the index. In
+// padded files the chunk plaintext starts with the number of bytes of it
+// that aren't padding, and the trailer length doesn't count padding. Each
+// chunk is authenticated on its own with a nonce made of its index and
+// whether it is the last one, and with the header hmac as additional data,
+// so chunks can't be reordered, dropped, cut off or moved between files.
+var fileMagic = []byte("KINDI")
+
+const (
+	defaultChunkSize = 64 << 10
+	maxChunkSize     = 16 << 20
+
+	chunkHeaderSize = 4
+	chunkFinalFlag  = 1 << 31
+	trailerSize     = 8 + 8 + 4
+	gcmTagSize      = 16
+
+	nonceData  = 0
+	nonceFinal = 1
+	nonceTrail = 2
+)
+
+// ErrNotSeekable is returned (wrapped) when random access is asked of a
+// file that doesn't support it.
+var ErrNotSeekable = errors.New("kindi file doesn't support random access")
+
+// Tags of the body parameters.
+const (
+	paramChunkSize   = 1
+	paramCompression = 2
+	paramPadding     = 3
+)
+
+// bodyParams tell how the body of a chunked file is encoded. They are
+// stored as tag (1 byte), length (4 bytes), value in the encrypted header.
+type bodyParams struct {
+	chunkSize   int
+	compression byte
+	padding     byte
+}
+
+// prefix returns the size of the byte count at the start of each chunk.
+func (p *bodyParams) prefix() int {
+	if p.padding != paddingNone {
+		return paddedChunkPrefix
+	}
+	return 0
+}
+
+func (p *bodyParams) encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+
+	buf.WriteByte(paramChunkSize)
+	binary.Write(buf, binary.BigEndian, uint32(4))
+	binary.Write(buf, binary.BigEndian, uint32(p.chunkSize))
+
+	if p.compression != compressionNone {
+		buf.WriteByte(paramCompression)
+		binary.Write(buf, binary.BigEndian, uint32(1))
+		buf.WriteByte(p.compression)
+	}
+
+	if p.padding != paddingNone {
+		buf.WriteByte(paramPadding)
+		binary.Write(buf, binary.BigEndian, uint32(1))
+		buf.WriteByte(p.padding)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeBodyParams(data []byte) (*bodyParams, error) {
+	p := new(bodyParams)
+
+	seen := make(map[byte]bool)
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("truncated body parameter")
+		}
+		tag := data[0]
+		if seen[tag] {
+			return nil, fmt.Errorf("body parameter %d appears twice", tag)
+		}
+		seen[tag] = true
+		n := binary.BigEndian.Uint32(data[1:5])
+		if uint64(n) > uint64(len(data)-5) {
+			return nil, fmt.Errorf("body parameter %d claims %d bytes, only %d left", tag, n, len(data)-5)
+		}
+		value := data[5 : 5+n]
+		data = data[5+n:]
+
+		switch tag {
+		case paramChunkSize:
+			if len(value) != 4 {
+				return nil, fmt.Errorf("chunk size parameter has %d bytes", len(value))
+			}
+			p.chunkSize = int(binary.BigEndian.Uint32(value))
+		case paramCompression:
+			if len(value) != 1 || value[0] == compressionNone || int(value[0]) >= len(compressionNames) {
+				return nil, fmt.Errorf("invalid compression parameter %v", value)
+			}
+			p.compression = value[0]
+		case paramPadding:
+			if len(value) != 1 || value[0] == paddingNone || int(value[0]) >= len(paddingNames) {
+				return nil, fmt.Errorf("invalid padding parameter %v", value)
+			}
+			p.padding = value[0]
+		default:
+			return nil, fmt.Errorf("unknown body parameter %d", tag)
+		}
+	}
+
+	if p.chunkSize <= p.prefix() || p.chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunk size %d out of range", p.chunkSize)
+	}
+	return p, nil
+}
+
+// newChunkAEAD returns the cipher for chunks and trailer, keyed by a key
+// derived from the symmetric key so it is never used with two ciphers.
+func newChunkAEAD(symmetricKey []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, symmetricKey)
+	mac.Write([]byte("kindi chunk key"))
+
+	c, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+func chunkNonce(index uint64, kind byte) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	nonce[8] = kind
+	return nonce
+}
+
+// chunkWriter encrypts everything written to it into chunks, sealing up to
+// workers chunks at once. Close pads, writes the last chunk and the trailer.
+type chunkWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	ad        []byte
+	chunkSize int
+	prefix    int
+	padding   byte
+	pipe      *pipeline
+	buf       []byte
+	index     uint64
+	length    uint64
+	err       error
+}
+
+func newChunkWriter(w io.Writer, symmetricKey, headerHash []byte, params *bodyParams, workers int) (*chunkWriter, error) {
+	aead, err := newChunkAEAD(symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := new(chunkWriter)
+	rv.w = w
+	rv.aead = aead
+	rv.ad = headerHash
+	rv.chunkSize = params.chunkSize
+	rv.prefix = params.prefix()
+	rv.padding = params.padding
+	rv.pipe = newPipeline(workers, func(data []byte) error {
+		_, err := w.Write(data)
+		return err
+	})
+	rv.buf = make([]byte, rv.prefix, params.chunkSize)
+	return rv, nil
+}
+
+// seal hands the buffered chunk, of which the first n bytes after the prefix
+// are plaintext, to the pipeline, which from then on owns the buffer.
+func (cw *chunkWriter) seal(final bool, n int) error {
+	if cw.prefix > 0 {
+		binary.BigEndian.PutUint32(cw.buf, uint32(n))
+	}
+
+	kind := byte(nonceData)
+	header := uint32(len(cw.buf))
+	if final {
+		kind = nonceFinal
+		header |= chunkFinalFlag
+	}
+
+	plaintext := cw.buf
+	nonce := chunkNonce(cw.index, kind)
+
+	err := cw.pipe.submit(func() ([]byte, error) {
+		out := make([]byte, chunkHeaderSize, chunkHeaderSize+len(plaintext)+cw.aead.Overhead())
+		binary.BigEndian.PutUint32(out, header)
+		return cw.aead.Seal(out, nonce, plaintext, cw.ad), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.index++
+	cw.buf = make([]byte, cw.prefix, cw.chunkSize)
+	return nil
+}
+
+// pad fills chunks with zeros up to the padded size and returns how many
+// bytes of the last one are plaintext. New buffers are zeroed already.
+func (cw *chunkWriter) pad() (int, error) {
+	n := len(cw.buf) - cw.prefix
+	padding := paddedSize(cw.padding, cw.length) - cw.length
+
+	for padding > 0 {
+		if len(cw.buf) == cw.chunkSize {
+			err := cw.seal(false, n)
+			if err != nil {
+				return 0, err
+			}
+			n = 0
+		}
+
+		k := uint64(cw.chunkSize - len(cw.buf))
+		if k > padding {
+			k = padding
+		}
+		cw.buf = cw.buf[:len(cw.buf)+int(k)]
+		padding -= k
+	}
+	return n, nil
+}
+
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	if cw.pipe == nil {
+		return 0, errors.New("write to closed chunk writer")
+	}
+
+	for len(p) > 0 {
+		// a full chunk is only written once more data shows it isn't the last
+		if len(cw.buf) == cw.chunkSize {
+			cw.err = cw.seal(false, cw.chunkSize-cw.prefix)
+			if cw.err != nil {
+				return n, cw.err
+			}
+		}
+
+		k := copy(cw.buf[len(cw.buf):cw.chunkSize], p)
+		cw.buf = cw.buf[:len(cw.buf)+k]
+		cw.length += uint64(k)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (cw *chunkWriter) Close() error {
+	if cw.pipe == nil {
+		return cw.err
+	}
+
+	if cw.err == nil {
+		n := len(cw.buf) - cw.prefix
+		if cw.padding != paddingNone {
+			n, cw.err = cw.pad()
+		}
+		if cw.err == nil {
+			cw.err = cw.seal(true, n)
+		}
+	}
+
+	err := cw.pipe.wait()
+	cw.pipe = nil
+	if cw.err == nil {
+		cw.err = err
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer, cw.length)
+	binary.BigEndian.PutUint64(trailer[8:], cw.index)
+	binary.BigEndian.PutUint32(trailer[16:], uint32(cw.chunkSize))
+
+	_, cw.err = cw.w.Write(cw.aead.Seal(nil, chunkNonce(cw.index, nonceTrail), trailer, cw.ad))
+	return cw.err
+}
+
+// openTrailer decrypts the trailer sealed after count chunks and returns
+// the plaintext length it records.
+func openTrailer(aead cipher.AEAD, ad, sealed []byte, count uint64, params *bodyParams) (uint64, error) {
+	trailer, err := aead.Open(nil, chunkNonce(count, nonceTrail), sealed, ad)
+	if err != nil {
+		return 0, fmt.Errorf("%w: trailer: %v", ErrMACMismatch, err)
+	}
+
+	length := binary.BigEndian.Uint64(trailer)
+	if binary.BigEndian.Uint64(trailer[8:]) != count || int(binary.BigEndian.Uint32(trailer[16:])) != params.chunkSize {
+		return 0, fmt.Errorf("%w: trailer doesn't match chunks", ErrMACMismatch)
+	}
+	return length, nil
+}
+
+// decryptChunks decrypts the chunks and trailer read from r into w, opening
+// up to workers chunks at once. Nothing after a chunk that fails to
+// authenticate is written to w.
+func decryptChunks(w io.Writer, r io.Reader, symmetricKey, headerHash []byte, params *bodyParams, workers int) error {
+	aead, err := newChunkAEAD(symmetricKey)
+	if err != nil {
+		return err
+	}
+
+	// chunks arrive here in order; in padded files only the last chunks
+	// may hold padding
+	var length uint64
+	padded := false
+	pipe := newPipeline(workers, func(plaintext []byte) error {
+		if params.padding != paddingNone {
+			n := uint64(binary.BigEndian.Uint32(plaintext))
+			plaintext = plaintext[paddedChunkPrefix:]
+			if n > uint64(len(plaintext)) || (padded && n > 0) {
+				return fmt.Errorf("%w: invalid plaintext length %d in padded chunk", ErrMACMismatch, n)
+			}
+			padded = padded || n < uint64(len(plaintext))
+			plaintext = plaintext[:n]
+		}
+
+		length += uint64(len(plaintext))
+		_, err := w.Write(plaintext)
+		return err
+	})
+
+	contentLength, index, err := readChunks(pipe, r, aead, headerHash, params)
+	perr := pipe.wait()
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, chunkHeaderSize)
+	sealed := make([]byte, trailerSize+aead.Overhead())
+	err = readFull(r, sealed, "trailer")
+	if err != nil {
+		return err
+	}
+
+	trailerLength, err := openTrailer(aead, headerHash, sealed, index, params)
+	if err != nil {
+		return err
+	}
+	if trailerLength != length || contentLength != paddedSize(params.padding, length) {
+		return fmt.Errorf("%w: trailer length %d, chunks hold %d bytes", ErrMACMismatch, trailerLength, length)
+	}
+
+	n, err := io.ReadFull(r, header[:1])
+	if n != 0 {
+		return &FormatError{Field: "trailer", Err: errors.New("data after trailer")}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// readChunks reads chunks from r up to the last one and submits them to
+// pipe for opening. It returns the plaintext length including padding and
+// the chunk count.
+func readChunks(pipe *pipeline, r io.Reader, aead cipher.AEAD, headerHash []byte, params *bodyParams) (uint64, uint64, error) {
+	header := make([]byte, chunkHeaderSize)
+	var length uint64
+	var index uint64
+
+	for final := false; !final; index++ {
+		err := readFull(r, header, fmt.Sprintf("chunk %d", index))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		v := binary.BigEndian.Uint32(header)
+		final = v&chunkFinalFlag != 0
+		n := int(v &^ chunkFinalFlag)
+		if n > params.chunkSize || n < params.prefix() || (!final && n != params.chunkSize) {
+			return 0, 0, &FormatError{Field: fmt.Sprintf("chunk %d", index), Err: fmt.Errorf("invalid length %d", n)}
+		}
+
+		kind := byte(nonceData)
+		if final {
+			kind = nonceFinal
+		}
+
+		buf := make([]byte, n+aead.Overhead())
+		err = readFull(r, buf, fmt.Sprintf("chunk %d", index))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		i := index
+		err = pipe.submit(func() ([]byte, error) {
+			plaintext, err := aead.Open(buf[:0], chunkNonce(i, kind), buf, headerHash)
+			if err != nil {
+				return nil, fmt.Errorf("%w: chunk %d: %v", ErrMACMismatch, i, err)
+			}
+			return plaintext, nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		length += uint64(n - params.prefix())
+	}
+
+	return length, index, nil
+}
+
+// Reader gives random access to the plaintext of a chunked .kindi file
+// opened with a key, version 4 or 2. It is safe for concurrent use through
+// ReadAt; Read and Seek share one offset.
+type Reader struct {
+	r          io.ReaderAt
+	aead       cipher.AEAD
+	ad         []byte
+	bodyOffset int64
+	chunkSize  int
+	prefix     int
+	capacity   int
+	chunks     uint64
+	lastLen    int
+	size       int64
+	filename   string
+	sender     string
+	metadata   Metadata
+
+	mu     sync.Mutex
+	cached uint64
+	chunk  []byte
+	off    int64
+}
+
+// OpenReader opens the .kindi file of size bytes in r for random access,
+// with the local key, verifying the sender like DecryptFile. Armored files,
+// version 1 files, passphrase files and compressed files fail with
+// ErrNotSeekable (wrapped).
+func OpenReader(r io.ReaderAt, size int64) (*Reader, error) {
+	return openReader(r, size, myPrivateKey, FetchCert)
+}
+
+func openReader(r io.ReaderAt, size int64, priv *rsa.PrivateKey, keychain keychainFunc) (*Reader, error) {
+	sr := io.NewSectionReader(r, 0, size)
+
+	magic := make([]byte, len(fileMagic)+1)
+	err := readFull(sr, magic, "magic")
+	if err != nil {
+		return nil, err
+	}
+	version := int(magic[len(fileMagic)])
+	if !bytes.Equal(magic[:len(fileMagic)], fileMagic) || (version != formatVersion2 && version != formatVersion4) {
+		return nil, fmt.Errorf("%w: only binary version %d and %d files do", ErrNotSeekable, formatVersion2, formatVersion4)
+	}
+
+	header, headerHash, err := readHeaderAndHash(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	symmetricKey, fields, err := verifyHeader(version, header, headerHash, priv, keychain)
+	if err != nil {
+		return nil, err
+	}
+	if fields.params == nil {
+		return nil, fmt.Errorf("%w: header has no body parameters", ErrMACMismatch)
+	}
+	if fields.params.compression != compressionNone {
+		return nil, fmt.Errorf("%w: body is compressed with %s", ErrNotSeekable, compressionName(fields.params.compression))
+	}
+
+	aead, err := newChunkAEAD(symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := new(Reader)
+	rv.r = r
+	rv.aead = aead
+	rv.ad = headerHash
+	rv.bodyOffset, _ = sr.Seek(0, io.SeekCurrent)
+	rv.chunkSize = fields.params.chunkSize
+	rv.prefix = fields.params.prefix()
+	rv.capacity = rv.chunkSize - rv.prefix
+	rv.filename = string(fields.filename)
+	rv.sender = string(fields.senderEmail)
+	rv.metadata = fields.metadata
+
+	// every chunk but the last one is stride bytes, the last one at
+	// least the overhead
+	stride := int64(chunkHeaderSize + rv.chunkSize + aead.Overhead())
+	sealedTrailerSize := int64(trailerSize + aead.Overhead())
+	body := size - rv.bodyOffset - sealedTrailerSize
+	minChunk := int64(chunkHeaderSize + aead.Overhead())
+	if body < minChunk {
+		return nil, &FormatError{Field: "body", Err: io.ErrUnexpectedEOF}
+	}
+	rv.chunks = uint64((body-minChunk)/stride + 1)
+
+	sealed := make([]byte, sealedTrailerSize)
+	_, err = r.ReadAt(sealed, size-sealedTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := openTrailer(aead, headerHash, sealed, rv.chunks, fields.params)
+	if err != nil {
+		return nil, err
+	}
+	rv.size = int64(length)
+
+	rv.lastLen = int(body - int64(rv.chunks-1)*stride - minChunk)
+	content := int64(rv.chunks-1)*int64(rv.capacity) + int64(rv.lastLen-rv.prefix)
+	if rv.lastLen < rv.prefix || uint64(content) != paddedSize(fields.params.padding, length) {
+		return nil, fmt.Errorf("%w: trailer length %d doesn't match the file size", ErrMACMismatch, rv.size)
+	}
+
+	rv.cached = ^uint64(0)
+	return rv, nil
+}
+
+// Size returns the length of the plaintext.
+func (cr *Reader) Size() int64 {
+	return cr.size
+}
+
+// Filename returns the name of the plaintext file recorded in the header.
+func (cr *Reader) Filename() string {
+	return cr.filename
+}
+
+// Sender returns the gmail address of the verified sender.
+func (cr *Reader) Sender() string {
+	return cr.sender
+}
+
+// Metadata returns the metadata section of the header.
+func (cr *Reader) Metadata() Metadata {
+	return cr.metadata
+}
+
+// readChunk returns the plaintext of chunk i. cr.mu must be held.
+func (cr *Reader) readChunk(i uint64) ([]byte, error) {
+	if i == cr.cached {
+		return cr.chunk, nil
+	}
+
+	final := i == cr.chunks-1
+	n := cr.chunkSize
+	kind := byte(nonceData)
+	if final {
+		n = cr.lastLen
+		kind = nonceFinal
+	}
+
+	stride := int64(chunkHeaderSize + cr.chunkSize + cr.aead.Overhead())
+	buf := make([]byte, chunkHeaderSize+n+cr.aead.Overhead())
+	_, err := cr.r.ReadAt(buf, cr.bodyOffset+int64(i)*stride)
+	if err != nil {
+		return nil, err
+	}
+
+	v := binary.BigEndian.Uint32(buf)
+	if (v&chunkFinalFlag != 0) != final || int(v&^chunkFinalFlag) != n {
+		return nil, &FormatError{Field: fmt.Sprintf("chunk %d", i), Err: errors.New("invalid header")}
+	}
+
+	plaintext, err := cr.aead.Open(buf[chunkHeaderSize:chunkHeaderSize], chunkNonce(i, kind), buf[chunkHeaderSize:], cr.ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d: %v", ErrMACMismatch, i, err)
+	}
+
+	if cr.prefix > 0 {
+		want := cr.size - int64(i)*int64(cr.capacity)
+		if want > int64(cr.capacity) {
+			want = int64(cr.capacity)
+		}
+		if int64(binary.BigEndian.Uint32(plaintext)) != want {
+			return nil, fmt.Errorf("%w: invalid plaintext length in padded chunk %d", ErrMACMismatch, i)
+		}
+		plaintext = plaintext[cr.prefix : cr.prefix+int(want)]
+	}
+
+	cr.cached = i
+	cr.chunk = plaintext
+	return plaintext, nil
+}
+
+// ReadAt implements io.ReaderAt, decrypting only the chunks p covers.
+func (cr *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for len(p) > 0 {
+		if off >= cr.size {
+			return n, io.EOF
+		}
+
+		i := uint64(off / int64(cr.capacity))
+		chunk, err := cr.readChunk(i)
+		if err != nil {
+			return n, err
+		}
+
+		k := copy(p, chunk[off-int64(i)*int64(cr.capacity):])
+		p = p[k:]
+		n += k
+		off += int64(k)
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (cr *Reader) Read(p []byte) (n int, err error) {
+	cr.mu.Lock()
+	off := cr.off
+	cr.mu.Unlock()
+
+	n, err = cr.ReadAt(p, off)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	cr.mu.Lock()
+	cr.off = off + int64(n)
+	cr.mu.Unlock()
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (cr *Reader) Seek(offset int64, whence int) (int64, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.off
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	cr.off = offset
+	return offset, nil
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func keychainFor(sender *rsa.PublicKey) keychainFunc {
+	return func(email []byte) (*rsa.PublicKey, error) {
+		return sender, nil
+	}
+}
+
+func encryptChunked(t *testing.T, payload []byte, chunkSize int) ([]byte, keychainFunc, *rsa.PrivateKey) {
+	envelope, sender, recipient := newTestEnvelope(t)
+	envelope.chunkSize = chunkSize
+
+	outbuffer := new(bytes.Buffer)
+	err := envelope.encrypt(outbuffer, bytes.NewReader(payload), []byte("disk.img"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+
+	return outbuffer.Bytes(), keychainFor(sender), recipient
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 99, 100, 101, 1000, 1050} {
+		payload := make([]byte, n)
+		rand.Read(payload)
+
+		encrypted, keychain, recipient := encryptChunked(t, payload, 100)
+
+		roundtripbuffer := new(bytes.Buffer)
+		err := decrypt(roundtripbuffer, bytes.NewReader(encrypted), recipient, keychain)
+		if err != nil {
+			t.Fatalf("%d bytes: failed to decrypt %v", n, err)
+		}
+		if !bytes.Equal(roundtripbuffer.Bytes(), payload) {
+			t.Fatalf("%d bytes: decrypted payload different from original payload", n)
+		}
+
+		cr, err := openReader(bytes.NewReader(encrypted), int64(len(encrypted)), recipient, keychain)
+		if err != nil {
+			t.Fatalf("%d bytes: failed to open reader %v", n, err)
+		}
+		if cr.Size() != int64(n) || cr.Filename() != "disk.img" || cr.Sender() != "foo@gmail.com" {
+			t.Fatalf("%d bytes: unexpected reader size %d, name %q, sender %q", n, cr.Size(), cr.Filename(), cr.Sender())
+		}
+
+		all, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("%d bytes: failed to read %v", n, err)
+		}
+		if !bytes.Equal(all, payload) {
+			t.Fatalf("%d bytes: read payload different from original payload", n)
+		}
+	}
+}
+
+func TestReaderRandomAccess(t *testing.T) {
+	payload := make([]byte, 1234)
+	rand.Read(payload)
+
+	encrypted, keychain, recipient := encryptChunked(t, payload, 100)
+
+	cr, err := openReader(bytes.NewReader(encrypted), int64(len(encrypted)), recipient, keychain)
+	if err != nil {
+		t.Fatalf("failed to open reader %v", err)
+	}
+
+	for _, r := range []struct{ off, n int }{{0, 10}, {95, 10}, {100, 100}, {250, 500}, {1200, 34}, {1233, 1}} {
+		p := make([]byte, r.n)
+		n, err := cr.ReadAt(p, int64(r.off))
+		if err != nil || n != r.n {
+			t.Fatalf("ReadAt(%d, %d) = %d, %v", r.n, r.off, n, err)
+		}
+		if !bytes.Equal(p, payload[r.off:r.off+r.n]) {
+			t.Fatalf("ReadAt(%d, %d) returned wrong bytes", r.n, r.off)
+		}
+	}
+
+	p := make([]byte, 10)
+	n, err := cr.ReadAt(p, 1230)
+	if n != 4 || err != io.EOF {
+		t.Fatalf("expected short read at the end with io.EOF, got %d, %v", n, err)
+	}
+
+	pos, err := cr.Seek(-34, io.SeekEnd)
+	if err != nil || pos != 1200 {
+		t.Fatalf("Seek returned %d, %v", pos, err)
+	}
+	rest, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if !bytes.Equal(rest, payload[1200:]) {
+		t.Fatalf("read after seek returned wrong bytes")
+	}
+}
+
+func TestChunkedTampering(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+
+	encrypted, keychain, recipient := encryptChunked(t, payload, 100)
+	stride := chunkHeaderSize + 100 + gcmTagSize
+	trailer := trailerSize + gcmTagSize
+	body := len(encrypted) - trailer - 10*stride
+
+	flipped := append([]byte(nil), encrypted...)
+	flipped[body+3*stride+20] ^= 1
+
+	swapped := append([]byte(nil), encrypted...)
+	copy(swapped[body+stride:], encrypted[body+2*stride:body+3*stride])
+	copy(swapped[body+2*stride:], encrypted[body+stride:body+2*stride])
+
+	dropped := append([]byte(nil), encrypted[:body+9*stride]...)
+	dropped = append(dropped, encrypted[len(encrypted)-trailer:]...)
+
+	for name, tampered := range map[string][]byte{
+		"flipped bit":      flipped,
+		"swapped chunks":   swapped,
+		"dropped chunk":    dropped,
+		"truncated":        encrypted[:len(encrypted)-trailer],
+		"trailing garbage": append(append([]byte(nil), encrypted...), 0),
+	} {
+		err := decrypt(ioutil.Discard, bytes.NewReader(tampered), recipient, keychain)
+		if err == nil {
+			t.Fatalf("%s: expected decrypt to fail", name)
+		}
+
+		cr, err := openReader(bytes.NewReader(tampered), int64(len(tampered)), recipient, keychain)
+		if err == nil {
+			_, err = ioutil.ReadAll(cr)
+		}
+		if err == nil {
+			t.Fatalf("%s: expected reader to fail", name)
+		}
+	}
+
+	_, err := ioutil.ReadAll(mustOpenReader(t, flipped, recipient, keychain))
+	if !errors.Is(err, ErrMACMismatch) {
+		t.Fatalf("expected ErrMACMismatch for a flipped bit, got %v", err)
+	}
+}
+
+func mustOpenReader(t *testing.T, encrypted []byte, recipient *rsa.PrivateKey, keychain keychainFunc) *Reader {
+	cr, err := openReader(bytes.NewReader(encrypted), int64(len(encrypted)), recipient, keychain)
+	if err != nil {
+		t.Fatalf("failed to open reader %v", err)
+	}
+	return cr
+}
+
+func TestReaderNotSeekable(t *testing.T) {
+	envelope, sender, recipient := newTestEnvelope(t)
+	keychain := func(email []byte) (*rsa.PublicKey, error) {
+		return sender, nil
+	}
+
+	outbuffer := new(bytes.Buffer)
+	err := encryptVersion1(envelope, outbuffer, bytes.NewBufferString("old"), []byte("old.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+
+	_, err = openReader(bytes.NewReader(outbuffer.Bytes()), int64(outbuffer.Len()), recipient, keychain)
+	if !errors.Is(err, ErrNotSeekable) {
+		t.Fatalf("expected ErrNotSeekable for a version 1 file, got %v", err)
+	}
+}
+
+func sealChunks(t testing.TB, payload, key, ad []byte, params *bodyParams, workers int) []byte {
+	outbuffer := new(bytes.Buffer)
+	cw, err := newChunkWriter(outbuffer, key, ad, params, workers)
+	if err != nil {
+		t.Fatalf("failed to create chunk writer %v", err)
+	}
+	_, err = cw.Write(payload)
+	if err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	return outbuffer.Bytes()
+}
+
+func TestParallelChunks(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	ad := []byte("header hmac")
+	params := &bodyParams{chunkSize: 64}
+
+	payload := make([]byte, 64*100+17)
+	rand.Read(payload)
+
+	sequential := sealChunks(t, payload, key, ad, params, 1)
+	parallel := sealChunks(t, payload, key, ad, params, 8)
+	if !bytes.Equal(sequential, parallel) {
+		t.Fatalf("parallel encryption produced different chunks than sequential encryption")
+	}
+
+	roundtripbuffer := new(bytes.Buffer)
+	err := decryptChunks(roundtripbuffer, bytes.NewReader(parallel), key, ad, params, 8)
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if !bytes.Equal(roundtripbuffer.Bytes(), payload) {
+		t.Fatalf("decrypted payload different from original payload")
+	}
+
+	// nothing from the damaged chunk on may reach the output
+	stride := chunkHeaderSize + 64 + gcmTagSize
+	parallel[50*stride+10] ^= 1
+	roundtripbuffer.Reset()
+	err = decryptChunks(roundtripbuffer, bytes.NewReader(parallel), key, ad, params, 8)
+	if !errors.Is(err, ErrMACMismatch) {
+		t.Fatalf("expected ErrMACMismatch, got %v", err)
+	}
+	if roundtripbuffer.Len() != 50*64 || !bytes.Equal(roundtripbuffer.Bytes(), payload[:50*64]) {
+		t.Fatalf("expected the 50 chunks before the damaged one, got %d bytes", roundtripbuffer.Len())
+	}
+}
+
+// benchmarkChunkedSize is the plaintext size of the chunk benchmarks. Run
+// them with -cpu 1,2,4,... to see how throughput scales with GOMAXPROCS.
+const benchmarkChunkedSize = 1 << 30
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func benchmarkEncryptChunks(b *testing.B, workers int) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	params := &bodyParams{chunkSize: defaultChunkSize}
+
+	b.SetBytes(benchmarkChunkedSize)
+	for i := 0; i < b.N; i++ {
+		cw, err := newChunkWriter(ioutil.Discard, key, nil, params, workers)
+		if err != nil {
+			b.Fatalf("failed to create chunk writer %v", err)
+		}
+		_, err = io.Copy(cw, io.LimitReader(zeroReader{}, benchmarkChunkedSize))
+		if err != nil {
+			b.Fatalf("failed to write %v", err)
+		}
+		err = cw.Close()
+		if err != nil {
+			b.Fatalf("failed to close %v", err)
+		}
+	}
+}
+
+func BenchmarkEncryptChunksSequential(b *testing.B) {
+	benchmarkEncryptChunks(b, 1)
+}
+
+func BenchmarkEncryptChunks(b *testing.B) {
+	benchmarkEncryptChunks(b, chunkWorkers())
+}
+
+func benchmarkDecryptChunks(b *testing.B, workers int) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	params := &bodyParams{chunkSize: defaultChunkSize}
+
+	f, err := ioutil.TempFile("", "kindi-bench")
+	if err != nil {
+		b.Fatalf("failed to create temp file %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cw, err := newChunkWriter(f, key, nil, params, chunkWorkers())
+	if err != nil {
+		b.Fatalf("failed to create chunk writer %v", err)
+	}
+	_, err = io.Copy(cw, io.LimitReader(zeroReader{}, benchmarkChunkedSize))
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		b.Fatalf("failed to encrypt %v", err)
+	}
+
+	b.SetBytes(benchmarkChunkedSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			b.Fatalf("failed to seek %v", err)
+		}
+		err = decryptChunks(ioutil.Discard, bufio.NewReaderSize(f, 1<<20), key, nil, params, workers)
+		if err != nil {
+			b.Fatalf("failed to decrypt %v", err)
+		}
+	}
+}
+
+func BenchmarkDecryptChunksSequential(b *testing.B) {
+	benchmarkDecryptChunks(b, 1)
+}
+
+func BenchmarkDecryptChunks(b *testing.B) {
+	benchmarkDecryptChunks(b, chunkWorkers())
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression methods recorded in the body parameters. The plaintext is
+// compressed before it is split into chunks.
+const (
+	compressionNone  = 0
+	compressionGzip  = 1
+	compressionFlate = 2
+)
+
+var compressionNames = []string{
+	compressionNone:  "none",
+	compressionGzip:  "gzip",
+	compressionFlate: "flate",
+}
+
+const (
+	// compressionSampleSize is how much of the input is compressed to
+	// decide whether compressing all of it is worth it.
+	compressionSampleSize = 64 << 10
+
+	// compressionMinSaving is the fraction of the sample compression has
+	// to save, otherwise the input is taken to be compressed already.
+	compressionMinSaving = 0.05
+)
+
+// CompressionMethods returns the names EncryptOptions.Compression accepts.
+func CompressionMethods() []string {
+	return append([]string(nil), compressionNames...)
+}
+
+func compressionByName(name string) (byte, error) {
+	if name == "" {
+		return compressionNone, nil
+	}
+	for i, n := range compressionNames {
+		if n == name {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q, want one of %v", name, compressionNames)
+}
+
+func compressionName(method byte) string {
+	if int(method) < len(compressionNames) {
+		return compressionNames[method]
+	}
+	return fmt.Sprintf("unknown (%d)", method)
+}
+
+// worthCompressing compresses sample quickly and reports whether that saved
+// enough to bother. Already compressed data (archives, images, video) comes
+// out as large as it went in.
+func worthCompressing(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+
+	var counter countWriter
+	fw, _ := flate.NewWriter(&counter, flate.BestSpeed)
+	fw.Write(sample)
+	fw.Close()
+
+	return float64(counter) < float64(len(sample))*(1-compressionMinSaving)
+}
+
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// newCompressWriter returns a writer compressing into w with method. Close
+// flushes the compressed stream but doesn't close w.
+func newCompressWriter(w io.Writer, method byte) (io.WriteCloser, error) {
+	switch method {
+	case compressionGzip:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case compressionFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return nil, fmt.Errorf("unknown compression %d", method)
+}
+
+// decompressWriter decompresses everything written to it into w. The
+// decompressor runs in its own goroutine, reading from a pipe.
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecompressWriter(w io.Writer, method byte) *decompressWriter {
+	pr, pw := io.Pipe()
+
+	rv := new(decompressWriter)
+	rv.pw = pw
+	rv.done = make(chan error, 1)
+
+	go func() {
+		err := decompress(w, bufio.NewReader(pr), method)
+		// unblocks the writer if the stream is damaged
+		pr.CloseWithError(err)
+		rv.done <- err
+	}()
+
+	return rv
+}
+
+func decompress(w io.Writer, br *bufio.Reader, method byte) error {
+	var zr io.Reader
+	switch method {
+	case compressionGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("compressed body: %v", err)
+		}
+		gr.Multistream(false)
+		zr = gr
+	case compressionFlate:
+		zr = flate.NewReader(br)
+	default:
+		return fmt.Errorf("unknown compression %d", method)
+	}
+
+	_, err := io.Copy(w, zr)
+	if err != nil {
+		return fmt.Errorf("compressed body: %v", err)
+	}
+
+	_, err = br.Peek(1)
+	if err != io.EOF {
+		return fmt.Errorf("compressed body is followed by data")
+	}
+	return nil
+}
+
+func (dw *decompressWriter) Write(p []byte) (int, error) {
+	return dw.pw.Write(p)
+}
+
+// Close waits for the decompressor and returns its error, if any.
+func (dw *decompressWriter) Close() error {
+	dw.pw.Close()
+	return <-dw.done
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func csvPayload() []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(buf, "%d,customer %d,%d.%02d,EUR\n", i, i%97, i*13%1000, i%100)
+	}
+	return buf.Bytes()
+}
+
+func TestCompression(t *testing.T) {
+	payload := csvPayload()
+
+	for _, method := range []byte{compressionGzip, compressionFlate} {
+		envelope, sender, recipient := newTestEnvelope(t)
+		envelope.compression = method
+		keychain := func(email []byte) (*rsa.PublicKey, error) {
+			return sender, nil
+		}
+
+		outbuffer := new(bytes.Buffer)
+		err := envelope.encrypt(outbuffer, bytes.NewReader(payload), []byte("export.csv"))
+		if err != nil {
+			t.Fatalf("%s: failed to encrypt %v", compressionName(method), err)
+		}
+		if envelope.compression != method {
+			t.Fatalf("%s: compression was skipped for csv", compressionName(method))
+		}
+		if outbuffer.Len() > len(payload)/3 {
+			t.Fatalf("%s: expected csv to compress, %d bytes became %d", compressionName(method), len(payload), outbuffer.Len())
+		}
+		encrypted := outbuffer.Bytes()
+
+		roundtripbuffer := new(bytes.Buffer)
+		err = decrypt(roundtripbuffer, bytes.NewReader(encrypted), recipient, keychain)
+		if err != nil {
+			t.Fatalf("%s: failed to decrypt %v", compressionName(method), err)
+		}
+		if !bytes.Equal(roundtripbuffer.Bytes(), payload) {
+			t.Fatalf("%s: decrypted payload different from original payload", compressionName(method))
+		}
+
+		savedKey := myPrivateKey
+		myPrivateKey = recipient
+		info, err := inspect(bytes.NewReader(encrypted), int64(len(encrypted)), "export.csv.kindi")
+		myPrivateKey = savedKey
+		if err != nil {
+			t.Fatalf("%s: failed to inspect %v", compressionName(method), err)
+		}
+		if info.Compression != compressionName(method) {
+			t.Fatalf("%s: inspect reports compression %q", compressionName(method), info.Compression)
+		}
+
+		_, err = openReader(bytes.NewReader(encrypted), int64(len(encrypted)), recipient, keychain)
+		if !errors.Is(err, ErrNotSeekable) {
+			t.Fatalf("%s: expected ErrNotSeekable for a compressed file, got %v", compressionName(method), err)
+		}
+	}
+}
+
+func TestCompressionSkipsCompressed(t *testing.T) {
+	payload := make([]byte, 100000)
+	rand.Read(payload)
+
+	savedConsole := console
+	console = ioutil.Discard
+	defer func() { console = savedConsole }()
+
+	envelope, sender, recipient := newTestEnvelope(t)
+	envelope.compression = compressionGzip
+
+	outbuffer := new(bytes.Buffer)
+	err := envelope.encrypt(outbuffer, bytes.NewReader(payload), []byte("photos.zip"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	if envelope.compression != compressionNone {
+		t.Fatalf("expected compression to be skipped for random data")
+	}
+
+	cr, err := openReader(bytes.NewReader(outbuffer.Bytes()), int64(outbuffer.Len()), recipient, func(email []byte) (*rsa.PublicKey, error) {
+		return sender, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to open reader %v", err)
+	}
+	if cr.Size() != int64(len(payload)) {
+		t.Fatalf("expected plaintext size %d, got %d", len(payload), cr.Size())
+	}
+}
+
+func TestDecompressWriterTrailingData(t *testing.T) {
+	compressed := new(bytes.Buffer)
+	zw, _ := newCompressWriter(compressed, compressionGzip)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	compressed.WriteString("garbage")
+
+	dw := newDecompressWriter(ioutil.Discard, compressionGzip)
+	dw.Write(compressed.Bytes())
+	if dw.Close() == nil {
+		t.Fatalf("expected data after the compressed stream to be rejected")
+	}
+}
@@ -29,6 +29,7 @@
 package kindi
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
 	"crypto/aes"
@@ -39,23 +40,52 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Errors returned (possibly wrapped) by EncryptFile and DecryptFile, so callers
+// can tell classes of failure apart with errors.Is.
+var (
+	ErrUnknownRecipient = errors.New("recipient has no kindi certificate")
+	ErrUnknownSender    = errors.New("sender has no kindi certificate")
+	ErrNotRecipient     = errors.New("file was not encrypted for this key")
+	ErrMACMismatch      = errors.New("expected hmac hash and calculated hmac hash not equal")
+	ErrSignature        = errors.New("sender signature verification failed")
 )
 
 type envelope struct {
-	senderEmail  []byte
-	senderKey    *rsa.PrivateKey
-	recipientKey *rsa.PublicKey
+	senderEmail []byte
+	senderKey   *rsa.PrivateKey
+
+	// recipientKeys can all decrypt, version 1 headers only have room for
+	// the first one.
+	recipientKeys []*rsa.PublicKey
+	chunkSize     int
+
+	// compression is the method asked for. encrypt sets it to
+	// compressionNone if the input doesn't look compressible.
+	compression byte
+	padding     byte
+	metadata    Metadata
+
+	// passphrase files derive the symmetric key from passphrase with kdf
+	// instead of wrapping a random one for recipientKeys, and have no sender.
+	passphrase []byte
+	kdf        *kdfParams
 }
 
 type keychainFunc func(email []byte) (*rsa.PublicKey, error)
 
 func newEnvelope(recipient *rsa.PublicKey) *envelope {
-	return &envelope{senderEmail: []byte(myGmail), senderKey: myPrivateKey, recipientKey: recipient}
+	return &envelope{senderEmail: []byte(myGmail), senderKey: myPrivateKey, recipientKeys: []*rsa.PublicKey{recipient}}
 }
 
 func newCipherStream(symmetricKey []byte) (cipher.Stream, hash.Hash, error) {
@@ -94,30 +124,54 @@ func writeLengthEncoded(w io.Writer, data []byte) error {
 	return nil
 }
 
-func readLengthEncoded(r io.Reader) (data []byte, err error) {
-	var dataLen int64
-	err = binary.Read(r, binary.BigEndian, &dataLen)
+// readLengthEncoded reads what writeLengthEncoded wrote. Lengths beyond max
+// and short reads are reported as a *FormatError for field.
+func readLengthEncoded(r io.Reader, field string, max int) (data []byte, err error) {
+	lenBytes := make([]byte, 8)
+	err = readFull(r, lenBytes, field)
 	if err != nil {
 		return nil, err
 	}
+
+	dataLen := int64(binary.BigEndian.Uint64(lenBytes))
+	if dataLen < 0 || dataLen > int64(max) {
+		return nil, &FormatError{Field: field, Err: fmt.Errorf("length %d exceeds %d", dataLen, max)}
+	}
+
 	data = make([]byte, dataLen)
-	_, err = r.Read(data)
+	err = readFull(r, data, field)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func (envelope *envelope) newHeader(symmetricKey []byte, name []byte) (header []byte, headerHash []byte, err error) {
+// newHeader wraps symmetricKey for the recipients and encrypts the sender,
+// signature, name, body parameters and metadata of a version version file.
+// params is nil for version 1 headers, which have neither. Versions 1 and 2
+// have a single wrapped key, version 3 passphrase headers record the key
+// derivation parameters instead and leave sender and signature empty.
+func (envelope *envelope) newHeader(version int, symmetricKey []byte, name []byte, params *bodyParams, metadata Metadata) (header []byte, headerHash []byte, err error) {
 	result := bytes.NewBuffer(make([]byte, 0, 1024))
 
-	hash := sha1.New()
-	encryptedSymmetricKey, err := rsa.EncryptOAEP(hash, rand.Reader, envelope.recipientKey, symmetricKey, nil)
-	if err != nil {
-		return nil, nil, err
+	switch version {
+	case formatVersion3:
+		err = writeLengthEncoded(result, envelope.kdf.encode())
+	case formatVersion1, formatVersion2:
+		var encryptedSymmetricKey []byte
+		encryptedSymmetricKey, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, envelope.recipientKeys[0], symmetricKey, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = writeLengthEncoded(result, encryptedSymmetricKey)
+	default:
+		var recipients []recipient
+		recipients, err = wrapKey(symmetricKey, envelope.recipientKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = writeLengthEncoded(result, encodeRecipients(recipients))
 	}
-
-	err = writeLengthEncoded(result, encryptedSymmetricKey)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -129,12 +183,15 @@ func (envelope *envelope) newHeader(symmetricKey []byte, name []byte) (header []
 		return nil, nil, err
 	}
 
-	hash = sha1.New()
-	hash.Write(envelope.senderEmail)
-	sum := hash.Sum(nil)
-	sig, err := rsa.SignPKCS1v15(rand.Reader, envelope.senderKey, crypto.SHA1, sum)
-	if err != nil {
-		return nil, nil, err
+	var sig []byte
+	if envelope.senderKey != nil {
+		hash := sha1.New()
+		hash.Write(envelope.senderEmail)
+		sum := hash.Sum(nil)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, envelope.senderKey, crypto.SHA1, sum)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	err = writeLengthEncoded(buf, sig)
@@ -147,13 +204,29 @@ func (envelope *envelope) newHeader(symmetricKey []byte, name []byte) (header []
 		return nil, nil, err
 	}
 
+	if params != nil {
+		err = writeLengthEncoded(buf, params.encode())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = writeLengthEncoded(buf, metadata.encode())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	stream, hmacHash, err := newCipherStream(symmetricKey)
 	if err != nil {
 		return nil, nil, err
 	}
+	hmacHash.Write(authenticatedPrefix(version, result.Bytes()))
 
 	encryptWriter := &cipher.StreamWriter{S: stream, W: io.MultiWriter(result, hmacHash)}
-	io.Copy(encryptWriter, buf)
+	_, err = io.Copy(encryptWriter, buf)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return result.Bytes(), hmacHash.Sum(nil), nil
 }
@@ -226,78 +299,290 @@ func (b *allButTailReader) fill() {
 	}
 }
 
-func decryptHeader(header []byte, headerHash []byte, priv *rsa.PrivateKey, keychain keychainFunc) ([]byte, []byte, []byte, error) {
+type headerFields struct {
+	senderEmail []byte
+	sig         []byte
+	filename    []byte
+	params      *bodyParams
+	metadata    Metadata
+}
+
+// openHeader unwraps the symmetric key of the header of a version version
+// file with priv, checks the header hmac and parses the encrypted header
+// fields. It does not verify the sender signature.
+func openHeader(version int, header []byte, headerHash []byte, priv *rsa.PrivateKey) ([]byte, *headerFields, error) {
 	buf := bytes.NewBuffer(header)
 
-	encryptedSymmetricKey, err := readLengthEncoded(buf)
-	if err != nil {
-		return nil, nil, nil, err
+	var encryptedSymmetricKey []byte
+	if version == formatVersion4 {
+		encoded, err := readLengthEncoded(buf, "recipients", maxRecipientsSize)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		recipients, err := decodeRecipients(encoded)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		encryptedSymmetricKey, err = findRecipient(recipients, keyFingerprint(&priv.PublicKey))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		encryptedSymmetricKey, err = readLengthEncoded(buf, "wrapped key", maxWrappedKeySize)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	hash := sha1.New()
 	decrypted, err := rsa.DecryptOAEP(hash, rand.Reader, priv, encryptedSymmetricKey, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, fmt.Errorf("%w: %v", ErrNotRecipient, err)
 	}
 
-	stream, hmacHash, err := newCipherStream(decrypted)
+	prefix := authenticatedPrefix(version, header[:len(header)-buf.Len()])
+	fields, err := openHeaderFields(buf, prefix, headerHash, decrypted)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+	return decrypted, fields, nil
+}
+
+// authenticatedPrefix returns what the header hmac of a version version file
+// covers before the encrypted header fields. From version 3 on that is the
+// magic, the version and keyBlock, the recipients or key derivation
+// parameters, so none of them can be swapped or stripped unnoticed.
+func authenticatedPrefix(version int, keyBlock []byte) []byte {
+	if version < formatVersion3 {
+		return nil
 	}
+	prefix := append(fileMagic[:len(fileMagic):len(fileMagic)], byte(version))
+	return append(prefix, keyBlock...)
+}
+
+// openHeaderFields decrypts the header fields in buf, the header after the
+// wrapped key or key derivation parameters, with symmetricKey and parses
+// them once the header hmac over prefix and the fields checks out.
+func openHeaderFields(buf *bytes.Buffer, prefix, headerHash, symmetricKey []byte) (*headerFields, error) {
+	stream, hmacHash, err := newCipherStream(symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	hmacHash.Write(prefix)
 
 	tempBuf := bytes.NewBuffer(make([]byte, 0, 1024))
 	decryptReader := &cipher.StreamReader{S: stream, R: &hashReader{r: buf, h: hmacHash}}
 
-	io.Copy(tempBuf, decryptReader)
+	_, err = io.Copy(tempBuf, decryptReader)
+	if err != nil {
+		return nil, err
+	}
 
-	if !bytes.Equal(headerHash, hmacHash.Sum(nil)) {
-		return nil, nil, nil, fmt.Errorf("expected hmac hash and calculated hmac hash not equal")
+	if !hmac.Equal(headerHash, hmacHash.Sum(nil)) {
+		return nil, ErrMACMismatch
 	}
 
-	senderEmail, err := readLengthEncoded(tempBuf)
+	fields := new(headerFields)
+
+	fields.senderEmail, err = readLengthEncoded(tempBuf, "sender", maxEmailSize)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
-	sig, err := readLengthEncoded(tempBuf)
+	fields.sig, err = readLengthEncoded(tempBuf, "signature", maxSignatureSize)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
+	}
+
+	fields.filename, err = readLengthEncoded(tempBuf, "filename", maxFilenameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if tempBuf.Len() > 0 {
+		encodedParams, err := readLengthEncoded(tempBuf, "body parameters", maxParamsSize)
+		if err != nil {
+			return nil, err
+		}
+
+		fields.params, err = decodeBodyParams(encodedParams)
+		if err != nil {
+			return nil, &FormatError{Field: "body parameters", Err: err}
+		}
+	}
+
+	if tempBuf.Len() > 0 {
+		encodedMetadata, err := readLengthEncoded(tempBuf, "metadata", maxMetadataSize)
+		if err != nil {
+			return nil, err
+		}
+
+		fields.metadata, err = decodeMetadata(encodedMetadata)
+		if err != nil {
+			return nil, &FormatError{Field: "metadata", Err: err}
+		}
+	}
+
+	if tempBuf.Len() > 0 {
+		return nil, &FormatError{Field: "header", Err: fmt.Errorf("%d bytes of trailing data", tempBuf.Len())}
 	}
 
-	filename, err := readLengthEncoded(tempBuf)
+	return fields, nil
+}
+
+// verifyHeader opens the header like openHeader and verifies the sender
+// signature against the certificate keychain returns.
+func verifyHeader(version int, header []byte, headerHash []byte, priv *rsa.PrivateKey, keychain keychainFunc) ([]byte, *headerFields, error) {
+	decrypted, fields, err := openHeader(version, header, headerHash, priv)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 
-	sender, err := keychain(senderEmail)
+	sender, err := keychain(fields.senderEmail)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	if sender == nil {
-		return nil, nil, nil, fmt.Errorf("Could not verify senders %s certificate", string(senderEmail))
+		return nil, nil, fmt.Errorf("Could not verify senders %s certificate: %w", string(fields.senderEmail), ErrUnknownSender)
 	}
 
-	hash = sha1.New()
-	hash.Write(senderEmail)
+	hash := sha1.New()
+	hash.Write(fields.senderEmail)
 	sum := hash.Sum(nil)
-	err = rsa.VerifyPKCS1v15(sender, crypto.SHA1, sum, sig)
+	err = rsa.VerifyPKCS1v15(sender, crypto.SHA1, sum, fields.sig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+
+	return decrypted, fields, nil
+}
+
+// readVersion reads the version of the binary .kindi stream r. Version 1
+// files have no magic; their first bytes are put back into the returned
+// reader.
+func readVersion(r io.Reader) (int, io.Reader, error) {
+	magic := make([]byte, len(fileMagic)+1)
+	err := readFull(r, magic, "magic")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !bytes.Equal(magic[:len(fileMagic)], fileMagic) {
+		return 1, io.MultiReader(bytes.NewReader(magic), r), nil
+	}
+
+	version := int(magic[len(fileMagic)])
+	if version != formatVersion2 && version != formatVersion3 && version != formatVersion4 {
+		return 0, nil, &FormatError{Field: "version", Err: fmt.Errorf("unsupported version %d", version)}
+	}
+	return version, r, nil
+}
+
+// headerOpener recovers the symmetric key and the fields of the header of a
+// file of the given version, verifying them.
+type headerOpener func(version int, header, headerHash []byte) ([]byte, *headerFields, error)
+
+// recipientOpener opens headers with priv and verifies the sender against the
+// certificate keychain returns.
+func recipientOpener(priv *rsa.PrivateKey, keychain keychainFunc) headerOpener {
+	return func(version int, header, headerHash []byte) ([]byte, *headerFields, error) {
+		if version == formatVersion3 {
+			return nil, nil, ErrPassphraseRequired
+		}
+		return verifyHeader(version, header, headerHash, priv, keychain)
+	}
+}
+
+// readHeader reads the version, header and header hmac from r and opens
+// them with open. The returned reader is positioned at the body.
+func readHeader(r io.Reader, open headerOpener) (int, []byte, []byte, *headerFields, io.Reader, error) {
+	version, r, err := readVersion(r)
+	if err != nil {
+		return 0, nil, nil, nil, nil, err
+	}
+
+	header, headerHash, err := readHeaderAndHash(r)
 	if err != nil {
-		return nil, nil, nil, err
+		return 0, nil, nil, nil, nil, err
+	}
+
+	symmetricKey, fields, err := open(version, header, headerHash)
+	if err != nil {
+		return 0, nil, nil, nil, nil, err
+	}
+
+	if (version == formatVersion1) == (fields.params != nil) {
+		return 0, nil, nil, nil, nil, fmt.Errorf("%w: body parameters don't match file version %d", ErrMACMismatch, version)
 	}
 
-	return decrypted, filename, senderEmail, nil
+	return version, symmetricKey, headerHash, fields, r, nil
 }
 
+// decryptBodyVersion decrypts the body of a file of the given version.
+func decryptBodyVersion(w io.Writer, r io.Reader, version int, symmetricKey, headerHash []byte, fields *headerFields) error {
+	if version == formatVersion1 {
+		return decryptBody(w, r, symmetricKey)
+	}
+
+	if fields.params.compression == compressionNone {
+		return decryptChunks(w, r, symmetricKey, headerHash, fields.params, chunkWorkers())
+	}
+
+	dw := newDecompressWriter(w, fields.params.compression)
+	err := decryptChunks(dw, r, symmetricKey, headerHash, fields.params, chunkWorkers())
+	cerr := dw.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// encrypt writes r as a version 4 .kindi file named name to w, or as a
+// version 3 file if the envelope has a passphrase.
 func (envelope *envelope) encrypt(w io.Writer, r io.Reader, name []byte) error {
+	params := &bodyParams{chunkSize: envelope.chunkSize, padding: envelope.padding}
+	if params.chunkSize == 0 {
+		params.chunkSize = defaultChunkSize
+	}
+	if params.chunkSize <= params.prefix() || params.chunkSize > maxChunkSize {
+		return fmt.Errorf("chunk size %d out of range (%d to %d)", params.chunkSize, params.prefix()+1, maxChunkSize)
+	}
+
+	if envelope.compression != compressionNone {
+		br := bufio.NewReaderSize(r, compressionSampleSize)
+		sample, _ := br.Peek(compressionSampleSize)
+		if !worthCompressing(sample) {
+			fmt.Fprintf(console, "not compressing %s, it doesn't look compressible\n", name)
+			envelope.compression = compressionNone
+		}
+		params.compression = envelope.compression
+		r = br
+	}
+
+	version := formatVersion4
 	symmetricKey := make([]byte, 32)
 
-	_, err := io.ReadFull(rand.Reader, symmetricKey)
+	var err error
+	if envelope.kdf != nil {
+		version = formatVersion3
+		symmetricKey, err = envelope.kdf.deriveKey(envelope.passphrase)
+	} else {
+		_, err = io.ReadFull(rand.Reader, symmetricKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	header, headerHash, err := envelope.newHeader(version, symmetricKey, name, params, envelope.metadata)
 	if err != nil {
 		return err
 	}
 
-	header, headerHash, err := envelope.newHeader(symmetricKey, name)
+	_, err = w.Write(append(fileMagic[:len(fileMagic):len(fileMagic)], byte(version)))
 	if err != nil {
 		return err
 	}
@@ -312,16 +597,35 @@ func (envelope *envelope) encrypt(w io.Writer, r io.Reader, name []byte) error {
 		return err
 	}
 
-	stream, hmacHash, err := newCipherStream(symmetricKey)
+	cw, err := newChunkWriter(w, symmetricKey, headerHash, params, chunkWorkers())
 	if err != nil {
 		return err
 	}
 
-	encryptWriter := &cipher.StreamWriter{S: stream, W: io.MultiWriter(w, hmacHash)}
-	io.Copy(encryptWriter, r)
-	w.Write(hmacHash.Sum(nil))
+	if params.compression == compressionNone {
+		_, err = io.Copy(cw, r)
+		if err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	}
 
-	return nil
+	zw, err := newCompressWriter(cw, params.compression)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	_, err = io.Copy(zw, r)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
 }
 
 func decryptBody(w io.Writer, r io.Reader, symmetricKey []byte) error {
@@ -333,93 +637,327 @@ func decryptBody(w io.Writer, r io.Reader, symmetricKey []byte) error {
 	abtr := newAllButTailReader(r, hmacHash.Size())
 
 	decryptReader := &cipher.StreamReader{S: stream, R: &hashReader{r: abtr, h: hmacHash}}
-	io.Copy(w, decryptReader)
+	_, err = io.Copy(w, decryptReader)
+	if err != nil {
+		return err
+	}
 
-	if !bytes.Equal(abtr.tmp[abtr.r:abtr.w], hmacHash.Sum(nil)) {
-		return fmt.Errorf("expected hmac hash and calculated hmac hash not equal")
+	if !hmac.Equal(abtr.tmp[abtr.r:abtr.w], hmacHash.Sum(nil)) {
+		return ErrMACMismatch
 	}
 
 	return nil
 }
 
 func decrypt(w io.Writer, r io.Reader, priv *rsa.PrivateKey, keychain keychainFunc) error {
-	header, err := readLengthEncoded(r)
+	version, symmetricKey, headerHash, fields, r, err := readHeader(dearmor(r), recipientOpener(priv, keychain))
 	if err != nil {
 		return err
 	}
 
-	headerHash, err := readLengthEncoded(r)
-	if err != nil {
-		return err
-	}
+	return decryptBodyVersion(w, r, version, symmetricKey, headerHash, fields)
+}
 
-	symmetricKey, _, _, err := decryptHeader(header, headerHash, priv, keychain)
-	if err != nil {
-		return err
+// EncryptOptions tweak how EncryptFile writes its output. A nil *EncryptOptions
+// selects the defaults.
+type EncryptOptions struct {
+	// Armor writes a PEM-like text block (name.kindi.asc) instead of raw binary.
+	Armor bool
+
+	// ChunkSize is the plaintext size of the independently authenticated
+	// chunks of the body, 64 KiB if zero. Random access reads decrypt
+	// whole chunks.
+	ChunkSize int
+
+	// Compression compresses the file before encrypting it, with one of
+	// CompressionMethods. Files that don't compress (judging by their
+	// first 64 KiB) are stored as they are. Compressed files can't be read
+	// with OpenReader.
+	Compression string
+
+	// Padding pads the (compressed) file with zeros before encrypting it, with
+	// one of PaddingSchemes, so the size of the .kindi file only tells the
+	// size class of the file: "padme" wastes at most 12%, "pow2" rounds up
+	// to a power of two.
+	Padding string
+
+	// Note and Expires go into the header metadata next to the modification
+	// time, permissions and content type of the file. Expires is a hint, a
+	// zero time leaves it out.
+	Note    string
+	Expires time.Time
+
+	// NoSelf leaves the sender out. By default EncryptFile also wraps the
+	// key for the sender's own key, so the sender can decrypt what they
+	// sent, and the file names both in its header.
+	NoSelf bool
+
+	// OutputName selects how the .kindi file is named: OutputNamePlain
+	// (the default) appends .kindi to the name of the file, which shows
+	// what it is to anybody who can list the folder. OutputNameRandom picks
+	// a random name, OutputNameHash names it after the SHA-256 of its
+	// content. Either way DecryptFile restores the original name from the
+	// encrypted header.
+	OutputName string
+}
+
+// Values of EncryptOptions.OutputName.
+const (
+	OutputNamePlain  = "plain"
+	OutputNameRandom = "random"
+	OutputNameHash   = "hash"
+)
+
+// Result describes a finished EncryptFile, DecryptFile, HideFile or RevealFile.
+type Result struct {
+	Input                 string   `json:"input"`
+	Output                string   `json:"output"`
+	Carrier               string   `json:"carrier,omitempty"`
+	Compression           string   `json:"compression,omitempty"` // as applied, "none" if skipped
+	Metadata              Metadata `json:"metadata,omitempty"`
+	Sender                string   `json:"sender,omitempty"`
+	SenderFingerprint     string   `json:"sender_fingerprint,omitempty"`
+	Recipients            []string `json:"recipients,omitempty"`
+	RecipientFingerprints []string `json:"recipient_fingerprints,omitempty"`
+}
+
+func EncryptFile(recipientEmail []byte, path string, opts *EncryptOptions) (*Result, error) {
+	return encryptFile(path, opts, func(opts *EncryptOptions) (*envelope, *Result, error) {
+		recipientKey, err := FetchCert(recipientEmail)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if recipientKey == nil {
+			return nil, nil, fmt.Errorf("Failed to find certificate for recipient %s: %w", string(recipientEmail), ErrUnknownRecipient)
+		}
+
+		envelope, result := recipientEnvelope(recipientEmail, recipientKey, opts.NoSelf)
+		return envelope, result, nil
+	})
+}
+
+// recipientEnvelope returns the envelope for recipientKey, wrapping the key
+// for the sender's own key as well unless noSelf, and the Result naming the
+// sender and recipients.
+func recipientEnvelope(recipientEmail []byte, recipientKey *rsa.PublicKey, noSelf bool) (*envelope, *Result) {
+	envelope := newEnvelope(recipientKey)
+	result := &Result{
+		Sender:                myGmail,
+		SenderFingerprint:     MyKeyFingerprint(),
+		Recipients:            []string{string(recipientEmail)},
+		RecipientFingerprints: []string{KeyFingerprint(recipientKey)},
 	}
 
-	return decryptBody(w, r, symmetricKey)
+	self := MyKeyFingerprint()
+	if !noSelf && len(self) > 0 && self != result.RecipientFingerprints[0] {
+		envelope.recipientKeys = append(envelope.recipientKeys, &myPrivateKey.PublicKey)
+		result.Recipients = append(result.Recipients, myGmail)
+		result.RecipientFingerprints = append(result.RecipientFingerprints, self)
+	}
+	return envelope, result
 }
 
-func EncryptFile(recipientEmail []byte, path string) error {
-	_, name := filepath.Split(path)
+// encryptFile writes the file at path as opts say into an envelope seal
+// returns, once the options are known to be good. seal also returns the
+// Result to fill in. opts is never nil for seal.
+func encryptFile(path string, opts *EncryptOptions, seal func(opts *EncryptOptions) (*envelope, *Result, error)) (*Result, error) {
+	if opts == nil {
+		opts = new(EncryptOptions)
+	}
+
+	dir, name := filepath.Dir(path), filepath.Base(path)
 
-	outPath := path + ".kindi"
+	ext := ".kindi"
+	if opts.Armor {
+		ext += ".asc"
+	}
+
+	var outPath string
+	switch opts.OutputName {
+	case "", OutputNamePlain:
+		outPath = path + ext
+	case OutputNameRandom:
+		random := make([]byte, 16)
+		_, err := io.ReadFull(rand.Reader, random)
+		if err != nil {
+			return nil, err
+		}
+		outPath = filepath.Join(dir, hex.EncodeToString(random)+ext)
+	case OutputNameHash:
+		// named once the output is written
+	default:
+		return nil, fmt.Errorf("unknown output name %q, want %s, %s or %s", opts.OutputName, OutputNamePlain, OutputNameRandom, OutputNameHash)
+	}
+
+	compression, err := compressionByName(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	padding, err := paddingByName(opts.Padding)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, result, err := seal(opts)
+	if err != nil {
+		return nil, err
+	}
 
 	r, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer r.Close()
 
-	w, err := os.Create(outPath)
+	fi, err := r.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	recipientKey, err := FetchCert(recipientEmail)
+	w, err := createAtomic(dir, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer w.abort()
+
+	result.Input = path
+	result.Output = outPath
 
-	if recipientKey == nil {
-		fmt.Printf("Recipient %s has not used Kindi yet. Please ask recipient to install Kindi and run it at least once.\n", string(recipientEmail))
-		return fmt.Errorf("Failed to find certificate for recipient %s", string(recipientEmail))
+	envelope.chunkSize = opts.ChunkSize
+	envelope.compression = compression
+	envelope.padding = padding
+	envelope.metadata = fileMetadata(fi)
+	if len(opts.Note) > 0 {
+		envelope.metadata[MetaNote] = opts.Note
+	}
+	if !opts.Expires.IsZero() {
+		envelope.metadata.setTime(MetaExpires, opts.Expires)
 	}
+	result.Metadata = envelope.metadata
 
-	envelope := newEnvelope(recipientKey)
+	outHash := sha256.New()
+	out := io.MultiWriter(w, outHash)
+
+	if opts.Armor {
+		var aw io.WriteCloser
+		aw, err = newArmorWriter(out)
+		if err == nil {
+			err = envelope.encrypt(aw, r, []byte(name))
+		}
+		if err == nil {
+			err = aw.Close()
+		}
+	} else {
+		err = envelope.encrypt(out, r, []byte(name))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if compression != compressionNone {
+		result.Compression = compressionName(envelope.compression)
+	}
+
+	if opts.OutputName == OutputNameHash {
+		result.Output = filepath.Join(dir, hex.EncodeToString(outHash.Sum(nil)[:16])+ext)
+	}
 
-	return envelope.encrypt(w, r, []byte(name))
+	err = w.commit(result.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
-func DecryptFile(path string) (string, string, error) {
-	dir, _ := filepath.Split(path)
+func DecryptFile(path string) (*Result, error) {
+	return decryptFile(path, nil)
+}
 
-	r, err := os.Open(path)
+func decryptFile(path string, passphrase []byte) (*Result, error) {
+	dir := filepath.Dir(path)
+
+	f, err := os.Open(path)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+	defer f.Close()
+
+	return decryptInto(dir, path, dearmor(f), passphrase)
+}
+
+// safeFilename reports whether name is a file name without any directory
+// parts, so decrypting can't write outside the directory of the input.
+func safeFilename(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00") && filepath.Base(name) == name
+}
+
+// decryptInto decrypts the .kindi stream r into a file in dir named as the
+// header says, with the permissions and modification time the metadata
+// records. input is what the Result reports as input. r is opened with
+// passphrase if it isn't nil, with the local key otherwise.
+func decryptInto(dir, input string, r io.Reader, passphrase []byte) (*Result, error) {
+	var senderKey *rsa.PublicKey
+	keychain := func(email []byte) (*rsa.PublicKey, error) {
+		var err error
+		senderKey, err = FetchCert(email)
+		return senderKey, err
+	}
+
+	open := recipientOpener(myPrivateKey, keychain)
+	if passphrase != nil {
+		open = passphraseOpener(passphrase)
 	}
 
-	header, err := readLengthEncoded(r)
+	version, symmetricKey, headerHash, fields, r, err := readHeader(r, open)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	headerHash, err := readLengthEncoded(r)
+	if !safeFilename(string(fields.filename)) {
+		return nil, fmt.Errorf("header names output file %q, which isn't a plain file name", fields.filename)
+	}
+	outPath := filepath.Join(dir, string(fields.filename))
+
+	w, err := createAtomic(dir, 0600)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
+	defer w.abort()
 
-	symmetricKey, filename, sender, err := decryptHeader(header, headerHash, myPrivateKey, FetchCert)
+	result := &Result{
+		Input:    input,
+		Output:   outPath,
+		Metadata: fields.metadata,
+	}
+	if passphrase == nil {
+		result.Sender = string(fields.senderEmail)
+		result.SenderFingerprint = KeyFingerprint(senderKey)
+		result.Recipients = []string{myGmail}
+		result.RecipientFingerprints = []string{MyKeyFingerprint()}
+	}
+
+	err = decryptBodyVersion(w, r, version, symmetricKey, headerHash, fields)
 	if err != nil {
-		return "", "", err
+		return result, err
 	}
 
-	outPath := filepath.Join(dir, string(filename))
+	err = applyMetadata(w.Name(), fields.metadata)
+	if err != nil {
+		return result, err
+	}
 
-	w, err := os.Create(outPath)
+	err = w.commit(outPath)
 	if err != nil {
-		return "", "", err
+		return result, err
 	}
 
-	return outPath, string(sender), decryptBody(w, r, symmetricKey)
+	expires, ok := fields.metadata.Time(MetaExpires)
+	if ok && time.Now().After(expires) {
+		fmt.Fprintf(console, "the sender marked %s as stale after %s\n", outPath, expires.Local().Format(time.RFC1123))
+	}
+	return result, nil
 }
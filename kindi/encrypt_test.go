@@ -31,12 +31,16 @@ package kindi
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
 	"testing"
 )
 
-func newTestEnvelope(t *testing.T) (*envelope, *rsa.PublicKey, *rsa.PrivateKey) {
+func newTestEnvelope(t testing.TB) (*envelope, *rsa.PublicKey, *rsa.PrivateKey) {
 	size := 1024
 	sender, err := rsa.GenerateKey(rand.Reader, size)
 	if err != nil {
@@ -48,9 +52,9 @@ func newTestEnvelope(t *testing.T) (*envelope, *rsa.PublicKey, *rsa.PrivateKey)
 	}
 
 	return &envelope{
-		senderEmail:  []byte("foo@gmail.com"),
-		senderKey:    sender,
-		recipientKey: &recipient.PublicKey,
+		senderEmail:   []byte("foo@gmail.com"),
+		senderKey:     sender,
+		recipientKeys: []*rsa.PublicKey{&recipient.PublicKey},
 	}, &sender.PublicKey, recipient
 }
 
@@ -61,12 +65,12 @@ func TestNewHeader(t *testing.T) {
 	rand.Read(symmetricKey)
 
 	nameBytes := []byte("foofile.dmg")
-	header, headerHash, err := envelope.newHeader(symmetricKey, nameBytes)
+	header, headerHash, err := envelope.newHeader(formatVersion1, symmetricKey, nameBytes, nil, nil)
 	if err != nil {
 		t.Fatalf("failed new header %v", err)
 	}
 
-	decryptedKey, name, _, err := decryptHeader(header, headerHash, recipient, func(email []byte) (*rsa.PublicKey, error) {
+	decryptedKey, fields, err := verifyHeader(formatVersion1, header, headerHash, recipient, func(email []byte) (*rsa.PublicKey, error) {
 		return sender, nil
 	})
 	if err != nil {
@@ -75,7 +79,7 @@ func TestNewHeader(t *testing.T) {
 	if !bytes.Equal(symmetricKey, decryptedKey) {
 		t.Fatalf("expected symmetric key and decrypted symmetric key not equal")
 	}
-	if !bytes.Equal(name, nameBytes) {
+	if !bytes.Equal(fields.filename, nameBytes) {
 		t.Fatalf("expected declared name and decrypted name not equal")
 	}
 }
@@ -111,3 +115,178 @@ func TestEncrypt(t *testing.T) {
 		t.Fatalf("decrypted payload different from original payload")
 	}
 }
+
+// encryptVersion1 writes r as a version 1 .kindi file, a single OFB stream
+// with a trailing hmac, as kindi did before chunked bodies.
+func encryptVersion1(envelope *envelope, w io.Writer, r io.Reader, name []byte) error {
+	symmetricKey := make([]byte, 32)
+	rand.Read(symmetricKey)
+
+	header, headerHash, err := envelope.newHeader(formatVersion1, symmetricKey, name, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	writeLengthEncoded(w, header)
+	writeLengthEncoded(w, headerHash)
+
+	stream, hmacHash, err := newCipherStream(symmetricKey)
+	if err != nil {
+		return err
+	}
+
+	encryptWriter := &cipher.StreamWriter{S: stream, W: io.MultiWriter(w, hmacHash)}
+	io.Copy(encryptWriter, r)
+	w.Write(hmacHash.Sum(nil))
+
+	return nil
+}
+
+func TestDecryptVersion1(t *testing.T) {
+	payload := []byte("written by an older kindi")
+	outbuffer := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	envelope, sender, recipient := newTestEnvelope(t)
+
+	err := encryptVersion1(envelope, outbuffer, bytes.NewBuffer(payload), []byte("old.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+
+	encrypted := outbuffer.Bytes()
+
+	roundtripbuffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	err = decrypt(roundtripbuffer, bytes.NewReader(encrypted), recipient, func(email []byte) (*rsa.PublicKey, error) {
+		return sender, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if !bytes.Equal(roundtripbuffer.Bytes(), payload) {
+		t.Fatalf("decrypted payload different from original payload")
+	}
+
+	info, err := inspect(bytes.NewReader(encrypted), int64(len(encrypted)), "old.txt.kindi")
+	if err != nil {
+		t.Fatalf("failed to inspect %v", err)
+	}
+	if info.Version != formatVersion1 || info.EncryptedBodySize != int64(len(payload)+sha256.Size) {
+		t.Fatalf("unexpected inspect result %+v", info)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	payload := []byte("nobody but the recipient should read this")
+	outbuffer := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	envelope, _, recipient := newTestEnvelope(t)
+
+	err := envelope.encrypt(outbuffer, bytes.NewBuffer(payload), []byte("foofile.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+
+	size := int64(outbuffer.Len())
+	encrypted := outbuffer.Bytes()
+
+	savedKey := myPrivateKey
+	defer func() { myPrivateKey = savedKey }()
+
+	myPrivateKey = nil
+	info, err := inspect(bytes.NewReader(encrypted), size, "foofile.txt.kindi")
+	if err != nil {
+		t.Fatalf("failed to inspect %v", err)
+	}
+	if info.Version != formatVersion4 {
+		t.Fatalf("expected version %d, got %d", formatVersion4, info.Version)
+	}
+	if len(info.Recipients) != 1 || info.Recipients[0] != KeyFingerprint(&recipient.PublicKey) {
+		t.Fatalf("expected the recipient fingerprint, got %v", info.Recipients)
+	}
+	bodySize := int64(chunkHeaderSize + len(payload) + gcmTagSize + trailerSize + gcmTagSize)
+	if info.EncryptedBodySize != bodySize {
+		t.Fatalf("expected encrypted body size %d, got %d", bodySize, info.EncryptedBodySize)
+	}
+	if info.CanDecrypt {
+		t.Fatalf("expected inspect without a key not to report it can decrypt")
+	}
+
+	myPrivateKey = recipient
+	info, err = inspect(bytes.NewReader(encrypted), size, "foofile.txt.kindi")
+	if err != nil {
+		t.Fatalf("failed to inspect %v", err)
+	}
+	if !info.CanDecrypt || info.Sender != "foo@gmail.com" || info.Filename != "foofile.txt" || info.ChunkSize != defaultChunkSize {
+		t.Fatalf("unexpected inspect result %+v", info)
+	}
+}
+
+func TestSafeFilename(t *testing.T) {
+	for name, safe := range map[string]bool{
+		"foo.txt":          true,
+		".hidden":          true,
+		"":                 false,
+		".":                false,
+		"..":               false,
+		"../foo.txt":       false,
+		"/etc/passwd":      false,
+		"dir/foo.txt":      false,
+		"..\\foo.txt":      false,
+		"foo\x00.txt":      false,
+		"report 2011.xlsx": true,
+	} {
+		if safeFilename(name) != safe {
+			t.Fatalf("expected safeFilename(%q) to be %v", name, safe)
+		}
+	}
+}
+
+func TestEncryptFileUnknownOutputName(t *testing.T) {
+	_, err := EncryptFile([]byte("bob@gmail.com"), "foo.txt", &EncryptOptions{OutputName: "secret"})
+	if err == nil {
+		t.Fatalf("expected an unknown output name to be rejected")
+	}
+}
+
+// limitedWriter fails like a full disk once n bytes have been written.
+type limitedWriter struct {
+	n int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > lw.n {
+		n := lw.n
+		lw.n = 0
+		return n, errors.New("no space left on device")
+	}
+	lw.n -= len(p)
+	return len(p), nil
+}
+
+func TestEncryptWriteErrors(t *testing.T) {
+	envelope, sender, recipient := newTestEnvelope(t)
+	envelope.chunkSize = 64
+
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+
+	full := new(bytes.Buffer)
+	err := envelope.encrypt(full, bytes.NewReader(payload), []byte("foo.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+
+	for n := 0; n < full.Len(); n += 37 {
+		err := envelope.encrypt(&limitedWriter{n: n}, bytes.NewReader(payload), []byte("foo.txt"))
+		if err == nil {
+			t.Fatalf("expected failing to write byte %d of %d to fail encryption", n, full.Len())
+		}
+	}
+
+	for _, n := range []int{0, 10, 500, len(payload) - 1} {
+		err := decrypt(&limitedWriter{n: n}, bytes.NewReader(full.Bytes()), recipient, keychainFor(sender))
+		if err == nil {
+			t.Fatalf("expected failing to write byte %d of %d to fail decryption", n, len(payload))
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// GIF carriers embed one bit per pixel in the lowest bit of its palette
+// index. The palette is laid out in pairs of near identical colors, 2i and
+// 2i+1 differ only in the lowest bit of blue, so flipping that bit doesn't
+// show. Paletted images with at most 128 opaque colors keep their colors,
+// everything else is dithered to a fixed palette of 128 colors first. Only
+// the first frame of animated GIFs is used.
+type gifCarrier struct{}
+
+const gifBaseColors = 128
+
+// gifBasePalette has 4 levels of red, 8 of green and 4 of blue.
+var gifBasePalette = func() color.Palette {
+	rv := make(color.Palette, 0, gifBaseColors)
+	for r := 0; r < 4; r++ {
+		for g := 0; g < 8; g++ {
+			for b := 0; b < 4; b++ {
+				rv = append(rv, color.NRGBA{uint8(r * 255 / 3), uint8(g * 255 / 7), uint8(b * 255 / 3), 0xff})
+			}
+		}
+	}
+	return rv
+}()
+
+func (gifCarrier) name() string         { return "gif" }
+func (gifCarrier) extensions() []string { return []string{".gif"} }
+
+func (gifCarrier) match(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("GIF87a")) || bytes.HasPrefix(header, []byte("GIF89a"))
+}
+
+func (gifCarrier) capacity(b image.Rectangle, opts *StegoOptions) (int, error) {
+	l, err := opts.layout()
+	if err != nil {
+		return 0, err
+	}
+	if l != defaultLayout {
+		return 0, fmt.Errorf("GIF carriers embed one bit per pixel, can't use %v", l)
+	}
+	parity, err := opts.parity()
+	if err != nil {
+		return 0, err
+	}
+
+	body := (b.Dx()*b.Dy() - framePreambleSize*8) / 8
+	rv := unprotectedSize(body, parity) - (frameSize([]PayloadItem{{}}) - framePreambleSize)
+	if rv < 0 {
+		return 0, nil
+	}
+	return rv, nil
+}
+
+func (c gifCarrier) encode(w io.Writer, items []PayloadItem, m image.Image, opts *StegoOptions) error {
+	_, err := c.capacity(m.Bounds(), opts)
+	if err != nil {
+		return err
+	}
+	parity, _ := opts.parity()
+
+	p := pairedPaletted(m)
+	it := newPalettedLSBReaderWriter(p)
+	it.setKey(opts.key())
+
+	size := protectedSize(frameSize(items)-framePreambleSize, parity)
+	available := it.Len() - framePreambleSize
+	if size > available {
+		return fmt.Errorf("%w: payload needs %d bytes, image holds %d bytes", ErrImageTooSmall, size, available)
+	}
+
+	err = writeFrame(it, items, defaultLayout, parity)
+	if err != nil {
+		return err
+	}
+
+	return gif.Encode(w, p, &gif.Options{NumColors: len(p.Palette)})
+}
+
+func (gifCarrier) decode(r io.Reader, key []byte, maxSize int) ([]PayloadItem, int, error) {
+	m, err := decodeGIF(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	p, ok := m.(*image.Paletted)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: GIF decoded to %T", ErrNoPayload, m)
+	}
+
+	it := newPalettedLSBReaderWriter(p)
+	it.setKey(key)
+	return readFrame(it, maxSize)
+}
+
+// decodeGIF decodes the first frame of a GIF, which can't be larger than the
+// logical screen DecodeConfig reports.
+var decodeGIF = limitedDecoder(gif.DecodeConfig, gif.Decode)
+
+func opaquePalette(p color.Palette) bool {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return false
+		}
+	}
+	return true
+}
+
+// pairedPaletted returns m as paletted image with all pixels on even palette
+// indices and odd ones holding a twin of the color before them.
+func pairedPaletted(m image.Image) *image.Paletted {
+	b := m.Bounds()
+
+	base, ok := m.(*image.Paletted)
+	if !ok || len(base.Palette) > gifBaseColors || !opaquePalette(base.Palette) {
+		base = image.NewPaletted(b, gifBasePalette)
+		draw.FloydSteinberg.Draw(base, b, m, b.Min)
+	}
+
+	palette := make(color.Palette, 0, 2*len(base.Palette))
+	for _, c := range base.Palette {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		twin := n
+		twin.B ^= 1
+		palette = append(palette, n, twin)
+	}
+
+	rv := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			rv.Pix[(y-b.Min.Y)*rv.Stride+x-b.Min.X] = 2 * base.ColorIndexAt(x, y)
+		}
+	}
+	return rv
+}
+
+// palettedLSBReaderWriter reads and writes a bit stream in the lowest bit of
+// the palette indices of m, one bit per pixel, lowest bit first.
+type palettedLSBReaderWriter struct {
+	m       *image.Paletted
+	order   *pixelOrder
+	npixels int
+	pixel   int
+}
+
+func newPalettedLSBReaderWriter(m *image.Paletted) *palettedLSBReaderWriter {
+	rv := new(palettedLSBReaderWriter)
+	rv.m = m
+	rv.npixels = m.Rect.Dx() * m.Rect.Dy()
+	return rv
+}
+
+func (it *palettedLSBReaderWriter) setKey(key []byte) {
+	if len(key) == 0 {
+		it.order = nil
+	} else {
+		it.order = newPixelOrder(key, it.npixels)
+	}
+	it.pixel = 0
+}
+
+// Len returns the number of whole bytes left.
+func (it *palettedLSBReaderWriter) Len() int {
+	return (it.npixels - it.pixel) / 8
+}
+
+func (it *palettedLSBReaderWriter) offset() int {
+	i := it.pixel
+	if it.order != nil {
+		i = it.order.pixel(i)
+	}
+	width := it.m.Rect.Dx()
+	return (i/width)*it.m.Stride + i%width
+}
+
+func (it *palettedLSBReaderWriter) Read(p []byte) (n int, err error) {
+	for j := range p {
+		var rv byte
+		for i := uint(0); i < 8; i++ {
+			if it.pixel >= it.npixels {
+				return n, io.EOF
+			}
+			rv |= (it.m.Pix[it.offset()] & 1) << i
+			it.pixel++
+		}
+		p[j] = rv
+		n++
+	}
+	return n, nil
+}
+
+func (it *palettedLSBReaderWriter) Write(p []byte) (n int, err error) {
+	for _, v := range p {
+		for i := uint(0); i < 8; i++ {
+			if it.pixel >= it.npixels {
+				return n, io.EOF
+			}
+			o := it.offset()
+			it.m.Pix[o] = it.m.Pix[o]&^1 | (v>>i)&1
+			it.pixel++
+		}
+		n++
+	}
+	return n, nil
+}
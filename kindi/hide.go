@@ -0,0 +1,179 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HideOptions tweak how HideFile embeds the encrypted file. A nil
+// *HideOptions selects the defaults.
+type HideOptions struct {
+	// Output is the path of the image to write, by default the carrier path
+	// with its extension replaced by .kindi and the extension of Format.
+	Output string
+
+	// Format is the image format to write (see CarrierFormats), by default
+	// the one the extension of Output names or PNG.
+	Format string
+
+	// Stego selects how the envelope is embedded, RevealFile needs the
+	// same Key.
+	Stego *StegoOptions
+
+	// NoSelf leaves the sender out, like EncryptOptions.NoSelf.
+	NoSelf bool
+}
+
+// HideFile encrypts the file at path for recipientEmail like EncryptFile and
+// embeds the result into the image at carrierPath (any format image.Decode
+// knows), written out in the format opts select. It fails with
+// ErrImageTooSmall (wrapped) if the carrier can't hold the encrypted file.
+func HideFile(recipientEmail []byte, path, carrierPath string, opts *HideOptions) (*Result, error) {
+	if opts == nil {
+		opts = new(HideOptions)
+	}
+
+	_, name := filepath.Split(path)
+
+	c := carrier(pngCarrier)
+	if len(opts.Format) > 0 {
+		var err error
+		c, err = carrierByName(opts.Format)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(opts.Output) > 0 {
+		c = carrierForPath(opts.Output)
+	}
+
+	outPath := opts.Output
+	if len(outPath) == 0 {
+		outPath = strings.TrimSuffix(carrierPath, filepath.Ext(carrierPath)) + ".kindi" + c.extensions()[0]
+	}
+
+	m, err := fetchImageOfMe(carrierPath)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := c.capacity(m.Bounds(), opts.Stego)
+	if err != nil {
+		return nil, err
+	}
+
+	// the envelope is the file plus a few hundred bytes of header, fail
+	// before encrypting if the file alone doesn't fit
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > int64(capacity) {
+		return nil, fmt.Errorf("%w: %s is %d bytes, %s holds %d bytes", ErrImageTooSmall, path, fi.Size(), carrierPath, capacity)
+	}
+
+	recipientKey, err := FetchCert(recipientEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	if recipientKey == nil {
+		return nil, fmt.Errorf("Failed to find certificate for recipient %s: %w", string(recipientEmail), ErrUnknownRecipient)
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, fi.Size()+1024))
+	envelope, result := recipientEnvelope(recipientEmail, recipientKey, opts.NoSelf)
+	envelope.metadata = fileMetadata(fi)
+	err = envelope.encrypt(buf, r, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > capacity {
+		return nil, fmt.Errorf("%w: encrypted %s is %d bytes, %s holds %d bytes", ErrImageTooSmall, path, buf.Len(), carrierPath, capacity)
+	}
+
+	w, err := createAtomic(filepath.Dir(outPath), 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer w.abort()
+
+	err = c.encode(w, []PayloadItem{{Type: PayloadEnvelope, Data: buf.Bytes()}}, m, opts.Stego)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.commit(outPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Input = path
+	result.Output = outPath
+	result.Carrier = carrierPath
+	return result, nil
+}
+
+// RevealFile extracts the encrypted file HideFile embedded into the image at
+// path and decrypts it next to the image, under the name recorded in the
+// envelope. Only the Key of opts matters.
+func RevealFile(path string, opts *StegoOptions) (*Result, error) {
+	dir := filepath.Dir(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the frame is bounded by the image, not by MaxPayloadSize
+	items, _, err := decodeCarrier(f, opts.key(), math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.Type == PayloadEnvelope {
+			return decryptInto(dir, path, bytes.NewReader(item.Data), nil)
+		}
+	}
+	return nil, fmt.Errorf("%w: no encrypted file among %d embedded items", ErrNoPayload, len(items))
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHideEnvelope(t *testing.T) {
+	payload := make([]byte, 2000)
+	rand.Read(payload)
+
+	envelope, sender, recipient := newTestEnvelope(t)
+
+	encrypted := bytes.NewBuffer(nil)
+	err := envelope.encrypt(encrypted, bytes.NewReader(payload), []byte("secret.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+
+	m := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	carrier := bytes.NewBuffer(nil)
+	err = EncodeItemsPNG(carrier, []PayloadItem{{Type: PayloadEnvelope, Data: encrypted.Bytes()}}, m, nil)
+	if err != nil {
+		t.Fatalf("failed to embed envelope %v", err)
+	}
+
+	items, err := DecodeItemsPNG(carrier, nil)
+	if err != nil {
+		t.Fatalf("failed to extract envelope %v", err)
+	}
+	if len(items) != 1 || items[0].Type != PayloadEnvelope {
+		t.Fatalf("expected one envelope item, got %v", items)
+	}
+
+	roundtrip := bytes.NewBuffer(nil)
+	err = decrypt(roundtrip, bytes.NewReader(items[0].Data), recipient, func(email []byte) (*rsa.PublicKey, error) {
+		return sender, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if !bytes.Equal(roundtrip.Bytes(), payload) {
+		t.Fatalf("revealed payload different from original payload")
+	}
+}
+
+func TestHideCarrierTooSmall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kindi")
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	carrierPath := filepath.Join(dir, "photo.png")
+	f, err := os.Create(carrierPath)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+	png.Encode(f, image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+	f.Close()
+
+	secretPath := filepath.Join(dir, "secret.txt")
+	err = ioutil.WriteFile(secretPath, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatalf("failed %v", err)
+	}
+
+	_, err = HideFile([]byte("bob@gmail.com"), secretPath, carrierPath, nil)
+	if !errors.Is(err, ErrImageTooSmall) {
+		t.Fatalf("expected ErrImageTooSmall, got %v", err)
+	}
+
+	_, err = RevealFile(carrierPath, nil)
+	if !errors.Is(err, ErrNoPayload) {
+		t.Fatalf("expected ErrNoPayload, got %v", err)
+	}
+}
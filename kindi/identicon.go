@@ -0,0 +1,99 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	identiconGrid    = 5
+	identiconMinSide = 240
+)
+
+// newIdenticon draws the default certificate holder image: a symmetric 5x5
+// pattern whose cells and colour are derived from the fingerprint of pub, so
+// every user's image looks different. The image is made big enough to hold
+// payloadSize bytes.
+func newIdenticon(pub *rsa.PublicKey, payloadSize int) (*image.NRGBA, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	// a margin of half a cell on each side
+	cells := identiconGrid + 1
+
+	neededPixels := (8*(payloadSize+frameSize([]PayloadItem{{}})) + 2) / 3
+	side := int(math.Ceil(math.Sqrt(float64(neededPixels))))
+	if side < identiconMinSide {
+		side = identiconMinSide
+	}
+	cellSize := (side + cells - 1) / cells
+	side = cellSize * cells
+	margin := cellSize / 2
+
+	fg := color.NRGBA{R: sum[0], G: sum[1], B: sum[2], A: 0xff}
+	// keep the foreground clearly darker than the background
+	fg.R, fg.G, fg.B = fg.R/2+0x20, fg.G/2+0x20, fg.B/2+0x20
+	bg := color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+	m := image.NewNRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			m.SetNRGBA(x, y, bg)
+		}
+	}
+
+	half := (identiconGrid + 1) / 2
+	for row := 0; row < identiconGrid; row++ {
+		for col := 0; col < half; col++ {
+			bit := row*half + col
+			if (sum[3+bit/8]>>uint(bit%8))&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconGrid - 1 - col} {
+				x0 := margin + c*cellSize
+				y0 := margin + row*cellSize
+				for y := y0; y < y0+cellSize; y++ {
+					for x := x0; x < x0+cellSize; x++ {
+						m.SetNRGBA(x, y, fg)
+					}
+				}
+			}
+		}
+	}
+	return m, nil
+}
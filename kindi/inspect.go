@@ -0,0 +1,211 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	formatVersion1      = 1
+	cipherSuiteVersion1 = "RSA-OAEP-SHA1 key wrap, AES-256-OFB, HMAC-SHA256, RSA-PKCS1v15-SHA1 signature"
+
+	formatVersion2      = 2
+	cipherSuiteVersion2 = "RSA-OAEP-SHA1 key wrap, AES-256-OFB header, HMAC-SHA256, RSA-PKCS1v15-SHA1 signature, AES-256-GCM chunks"
+
+	formatVersion3      = 3
+	cipherSuiteVersion3 = "scrypt key derivation, AES-256-OFB header, HMAC-SHA256, AES-256-GCM chunks"
+
+	formatVersion4      = 4
+	cipherSuiteVersion4 = cipherSuiteVersion2
+)
+
+// FileInfo describes a .kindi file as far as it can be determined without
+// writing any plaintext.
+type FileInfo struct {
+	Path        string `json:"path"`
+	Version     int    `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	Armored     bool   `json:"armored"`
+
+	FileSize       int64 `json:"file_size"`
+	HeaderSize     int64 `json:"header_size"`
+	WrappedKeySize int64 `json:"wrapped_key_size"`
+
+	// EncryptedBodySize is the size of everything after the header hmac:
+	// chunks and trailer, or the encrypted stream and its hmac in version 1
+	// files. How much plaintext that holds depends on the chunk size,
+	// padding and compression in the encrypted header.
+	EncryptedBodySize int64 `json:"encrypted_body_size"`
+
+	// ChunkSize is the plaintext size of the body chunks of version 2 to 4
+	// files, Compression and Padding how that plaintext is compressed and
+	// padded. They are in the encrypted header, so only known if CanDecrypt.
+	ChunkSize   int    `json:"chunk_size,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Padding     string `json:"padding,omitempty"`
+
+	// Metadata is the metadata section of the encrypted header, if
+	// CanDecrypt.
+	Metadata Metadata `json:"metadata,omitempty"`
+
+	// KDF describes how the key of passphrase files (version 3) is derived
+	// from the passphrase, they have no wrapped key and no recipients.
+	KDF string `json:"kdf,omitempty"`
+
+	// Recipients holds the key fingerprints of the recipients. Only version 4
+	// files carry them.
+	Recipients []string `json:"recipients"`
+
+	// CanDecrypt is true if the local key unwraps the symmetric key and the
+	// header hmac checks out. Sender and Filename are only filled in then;
+	// the sender signature is not verified by Inspect.
+	CanDecrypt bool   `json:"can_decrypt"`
+	Sender     string `json:"sender,omitempty"`
+	Filename   string `json:"filename,omitempty"`
+}
+
+// Inspect parses the outer structure of the .kindi file at path and reports
+// what it finds. If a keychain has been loaded it also checks whether the
+// local key can open the file.
+func Inspect(path string) (*FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return inspect(f, fi.Size(), path)
+}
+
+func inspect(rin io.Reader, size int64, path string) (*FileInfo, error) {
+	info := new(FileInfo)
+	info.Path = path
+	info.FileSize = size
+
+	r := dearmor(rin)
+	_, info.Armored = r.(*armorReader)
+
+	version, r, err := readVersion(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header, headerHash, err := readHeaderAndHash(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrappedKeySize int64
+	switch version {
+	case formatVersion3:
+		encoded, err := readLengthEncoded(bytes.NewBuffer(header), "key derivation parameters", maxKDFParamsSize)
+		if err != nil {
+			return nil, err
+		}
+		kdf, err := decodeKDFParams(encoded)
+		if err != nil {
+			return nil, &FormatError{Field: "key derivation parameters", Err: err}
+		}
+		info.KDF = kdf.String()
+	case formatVersion4:
+		encoded, err := readLengthEncoded(bytes.NewBuffer(header), "recipients", maxRecipientsSize)
+		if err != nil {
+			return nil, err
+		}
+		recipients, err := decodeRecipients(encoded)
+		if err != nil {
+			return nil, err
+		}
+		info.Recipients = make([]string, len(recipients))
+		for i, r := range recipients {
+			info.Recipients[i] = hex.EncodeToString(r.fingerprint)
+			wrappedKeySize += int64(len(r.wrappedKey))
+		}
+	default:
+		wrappedKey, err := readLengthEncoded(bytes.NewBuffer(header), "wrapped key", maxWrappedKeySize)
+		if err != nil {
+			return nil, err
+		}
+		wrappedKeySize = int64(len(wrappedKey))
+	}
+
+	rest, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Version = version
+	info.HeaderSize = int64(len(header))
+	info.WrappedKeySize = wrappedKeySize
+	info.EncryptedBodySize = rest
+	minBody := int64(chunkHeaderSize + gcmTagSize + trailerSize + gcmTagSize)
+	switch version {
+	case formatVersion3:
+		info.CipherSuite = cipherSuiteVersion3
+	case formatVersion2:
+		info.CipherSuite = cipherSuiteVersion2
+	case formatVersion4:
+		info.CipherSuite = cipherSuiteVersion4
+	default:
+		info.CipherSuite = cipherSuiteVersion1
+		minBody = sha256.Size
+	}
+	if rest < minBody {
+		return nil, &FormatError{Field: "body", Err: fmt.Errorf("%d bytes, want at least %d", rest, minBody)}
+	}
+
+	if myPrivateKey != nil && version != formatVersion3 {
+		_, fields, err := openHeader(version, header, headerHash, myPrivateKey)
+		if err == nil {
+			info.CanDecrypt = true
+			info.Sender = string(fields.senderEmail)
+			info.Filename = string(fields.filename)
+			if fields.params != nil {
+				info.ChunkSize = fields.params.chunkSize
+				info.Compression = compressionName(fields.params.compression)
+				info.Padding = paddingName(fields.params.padding)
+			}
+			info.Metadata = fields.metadata
+		}
+	}
+
+	return info, nil
+}
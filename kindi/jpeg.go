@@ -0,0 +1,240 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// JPEG carriers can't keep payloads in pixel LSBs, lossy compression destroys
+// them. Instead the frame goes into APP11 segments, which survive as long as
+// whatever handles the image keeps metadata. Each segment starts with
+// jpegSegmentTag, the 1-based index of the segment and the number of
+// segments, followed by a piece of the frame.
+var jpegSegmentTag = []byte("KINDI\x00")
+
+const (
+	jpegMarkerAPP11    = 0xeb
+	jpegMaxSegmentData = 0xffff - 2 - 6 - 2
+	jpegMaxSegments    = 255
+	jpegQuality        = 90
+)
+
+// EncodeItemsJPEG writes m as JPEG to w, with items embedded.
+func EncodeItemsJPEG(w io.Writer, items []PayloadItem, m image.Image) error {
+	frame := bytes.NewBuffer(make([]byte, 0, frameSize(items)))
+	err := writeFrame(frame, items, defaultLayout, 0)
+	if err != nil {
+		return err
+	}
+
+	count := (frame.Len() + jpegMaxSegmentData - 1) / jpegMaxSegmentData
+	if count > jpegMaxSegments {
+		return fmt.Errorf("%w: payload needs %d bytes, JPEG segments hold %d bytes", ErrImageTooSmall, frame.Len(), jpegMaxSegments*jpegMaxSegmentData)
+	}
+
+	encoded := bytes.NewBuffer(make([]byte, 0, 64<<10))
+	err = jpeg.Encode(encoded, m, &jpeg.Options{Quality: jpegQuality})
+	if err != nil {
+		return err
+	}
+
+	jpg := encoded.Bytes()
+
+	// SOI, then our segments, then whatever the encoder wrote after SOI
+	_, err = w.Write(jpg[:2])
+	if err != nil {
+		return err
+	}
+
+	data := frame.Bytes()
+	for i := 0; i < count; i++ {
+		chunk := data[i*jpegMaxSegmentData:]
+		if len(chunk) > jpegMaxSegmentData {
+			chunk = chunk[:jpegMaxSegmentData]
+		}
+
+		segment := bytes.NewBuffer(make([]byte, 0, len(chunk)+12))
+		segment.Write([]byte{0xff, jpegMarkerAPP11})
+		binary.Write(segment, binary.BigEndian, uint16(2+len(jpegSegmentTag)+2+len(chunk)))
+		segment.Write(jpegSegmentTag)
+		segment.Write([]byte{byte(i + 1), byte(count)})
+		segment.Write(chunk)
+
+		_, err = w.Write(segment.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(jpg[2:])
+	return err
+}
+
+// DecodeItemsJPEG returns the items embedded in the JPEG image read from rin.
+func DecodeItemsJPEG(rin io.Reader) ([]PayloadItem, error) {
+	return decodeItemsJPEG(rin, MaxPayloadSize)
+}
+
+func decodeItemsJPEG(rin io.Reader, maxSize int) ([]PayloadItem, error) {
+	br := bufio.NewReader(rin)
+
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(br, soi)
+	if err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, fmt.Errorf("not a JPEG image")
+	}
+
+	var chunks [][]byte
+	count := 0
+
+	for {
+		marker, err := readJPEGMarker(br)
+		if err != nil {
+			return nil, err
+		}
+
+		// start of scan or end of image: no more metadata segments
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		// markers without a length
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue
+		}
+
+		var length uint16
+		err = binary.Read(br, binary.BigEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, fmt.Errorf("invalid JPEG segment length %d", length)
+		}
+
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(br, segment)
+		if err != nil {
+			return nil, err
+		}
+
+		if marker != jpegMarkerAPP11 || !bytes.HasPrefix(segment, jpegSegmentTag) {
+			continue
+		}
+
+		segment = segment[len(jpegSegmentTag):]
+		if len(segment) < 2 || segment[0] == 0 || segment[0] > segment[1] {
+			return nil, fmt.Errorf("%w: invalid kindi JPEG segment header", ErrPayloadCorrupt)
+		}
+		if count == 0 {
+			count = int(segment[1])
+			chunks = make([][]byte, count)
+		}
+		if int(segment[1]) != count {
+			return nil, fmt.Errorf("%w: kindi JPEG segments disagree on their number", ErrPayloadCorrupt)
+		}
+		chunks[segment[0]-1] = segment[2:]
+	}
+
+	if count == 0 {
+		return nil, ErrNoPayload
+	}
+
+	frame := bytes.NewBuffer(nil)
+	for i, chunk := range chunks {
+		if chunk == nil {
+			return nil, fmt.Errorf("%w: kindi JPEG segment %d of %d missing", ErrPayloadCorrupt, i+1, count)
+		}
+		frame.Write(chunk)
+	}
+
+	items, _, err := readFrame(bytes.NewReader(frame.Bytes()), maxSize)
+	if err == ErrNoPayload {
+		return nil, fmt.Errorf("%w: kindi JPEG segments don't hold a frame", ErrPayloadCorrupt)
+	}
+	return items, err
+}
+
+func readJPEGMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("expected JPEG marker, got 0x%02x", b)
+	}
+	// any number of 0xff fill bytes may precede the marker
+	for b == 0xff {
+		b, err = br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// jpegCarrier embeds frames into JPEG APP11 segments. Layouts, keys and
+// redundancy have no meaning there.
+type jpegCarrier struct{}
+
+func (jpegCarrier) name() string         { return "jpeg" }
+func (jpegCarrier) extensions() []string { return []string{".jpg", ".jpeg"} }
+
+func (jpegCarrier) match(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0xff, 0xd8})
+}
+
+func (jpegCarrier) capacity(b image.Rectangle, opts *StegoOptions) (int, error) {
+	if len(opts.key()) > 0 {
+		return 0, fmt.Errorf("JPEG carriers can't scatter payloads by key")
+	}
+	return jpegMaxSegments*jpegMaxSegmentData - frameSize([]PayloadItem{{}}), nil
+}
+
+func (c jpegCarrier) encode(w io.Writer, items []PayloadItem, m image.Image, opts *StegoOptions) error {
+	_, err := c.capacity(m.Bounds(), opts)
+	if err != nil {
+		return err
+	}
+	return EncodeItemsJPEG(w, items, m)
+}
+
+func (jpegCarrier) decode(r io.Reader, key []byte, maxSize int) ([]PayloadItem, int, error) {
+	items, err := decodeItemsJPEG(r, maxSize)
+	return items, 0, err
+}
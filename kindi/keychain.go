@@ -32,8 +32,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -41,7 +43,6 @@ import (
 	"io"
 	"io/ioutil"
 	"math/big"
-	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -58,6 +59,15 @@ var myPrivateKey *rsa.PrivateKey
 
 var myGmail string
 
+// console receives prompts and progress messages. It defaults to stdout.
+var console io.Writer = os.Stdout
+
+// SetConsole redirects prompts and progress messages, e.g. to keep stdout
+// free for machine-readable output.
+func SetConsole(w io.Writer) {
+	console = w
+}
+
 func mkKindiDir(path string) (string, error) {
 	var name string
 
@@ -111,7 +121,105 @@ func FetchCert(email []byte) (*rsa.PublicKey, error) {
 	return parseCertificate(certBytes)
 }
 
-func InitKeychain(configDir string) error {
+// KeyFingerprint returns the hex encoded SHA-256 hash of the PKIX encoding of pub.
+func KeyFingerprint(pub *rsa.PublicKey) string {
+	fp := keyFingerprint(pub)
+	if fp == nil {
+		return ""
+	}
+	return hex.EncodeToString(fp)
+}
+
+func keyFingerprint(pub *rsa.PublicKey) []byte {
+	if pub == nil {
+		return nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(der)
+	return sum[:]
+}
+
+// MyGmail returns the gmail address of the loaded keychain.
+func MyGmail() string {
+	return myGmail
+}
+
+// MyKeyFingerprint returns the fingerprint of the local key, or an empty
+// string if no keychain has been loaded.
+func MyKeyFingerprint() string {
+	if myPrivateKey == nil {
+		return ""
+	}
+	return KeyFingerprint(&myPrivateKey.PublicKey)
+}
+
+// OpenKeychain loads the gmail address and private key from an already
+// initialized config directory. Unlike InitKeychain it never prompts,
+// generates keys or talks to picasaweb.
+func OpenKeychain(configDir string) error {
+	kindiDirName, err := mkKindiDir(configDir)
+	if err != nil {
+		return err
+	}
+
+	userBytes, err := readAll(filepath.Join(kindiDirName, "me"))
+	if err != nil {
+		return err
+	}
+
+	keyBytes, err := readAll(filepath.Join(kindiDirName, "me_key.pem"))
+	if err != nil {
+		return err
+	}
+
+	priv, err := parseKey(keyBytes)
+	if err != nil {
+		return err
+	}
+
+	myGmail = string(userBytes)
+	myPrivateKey = priv
+	return nil
+}
+
+// InitOptions control how InitKeychain sets up the config directory. A nil
+// *InitOptions prompts for whatever is missing.
+type InitOptions struct {
+	// Email is the gmail address to use if the config directory doesn't have one yet.
+	Email string
+
+	// ImagePath is the image used as certificate holder if a new key is generated.
+	ImagePath string
+
+	// NoPublish skips checking and uploading the certificate to picasaweb.
+	// Use Publish to do that later.
+	NoPublish bool
+
+	// NonInteractive makes InitKeychain fail with ErrInputRequired instead of
+	// prompting. A missing ImagePath selects the default image.
+	NonInteractive bool
+}
+
+// ErrInputRequired is returned by InitKeychain when it would have to prompt
+// but runs non-interactively.
+var ErrInputRequired = errors.New("input required, but running non-interactively")
+
+func normalizeGmail(gmail string) string {
+	gmail = strings.TrimSpace(gmail)
+	if len(gmail) > 0 && !strings.Contains(gmail, "@") {
+		gmail = gmail + "@gmail.com"
+	}
+	return gmail
+}
+
+func InitKeychain(configDir string, opts *InitOptions) error {
+	if opts == nil {
+		opts = new(InitOptions)
+	}
+
 	kindiDirName, err := mkKindiDir(configDir)
 	if err != nil {
 		return err
@@ -121,12 +229,19 @@ func InitKeychain(configDir string) error {
 	_, err = os.Stat(userPath)
 	if err != nil {
 		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOENT {
-			fmt.Printf("Please enter your gmail address (full address with @gmail.com or your @ Google Apps domain): ")
-			gmail := ""
-			fmt.Scanln(&gmail)
-
-			if !strings.Contains(gmail, "@") {
-				gmail = gmail + "@gmail.com"
+			gmail := normalizeGmail(opts.Email)
+			if len(gmail) == 0 {
+				if opts.NonInteractive {
+					return fmt.Errorf("no gmail address given: %w", ErrInputRequired)
+				}
+
+				fmt.Fprintf(console, "Please enter your gmail address (full address with @gmail.com or your @ Google Apps domain): ")
+				fmt.Scanln(&gmail)
+
+				gmail = normalizeGmail(gmail)
+				if len(gmail) == 0 {
+					return fmt.Errorf("no gmail address entered")
+				}
 			}
 
 			userOut, err := os.OpenFile(userPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
@@ -148,6 +263,10 @@ func InitKeychain(configDir string) error {
 
 	myGmail = string(userBytes)
 
+	if len(opts.Email) > 0 && normalizeGmail(opts.Email) != myGmail {
+		return fmt.Errorf("config directory %s is already initialized for %s", kindiDirName, myGmail)
+	}
+
 	meKeyPath := filepath.Join(kindiDirName, "me_key.pem")
 	meCertPath := filepath.Join(kindiDirName, "me_cert.pem")
 	mePNGPath := filepath.Join(kindiDirName, "me_cert.png")
@@ -155,11 +274,13 @@ func InitKeychain(configDir string) error {
 	_, err = os.Stat(meKeyPath)
 	if err != nil {
 		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOENT {
-			fmt.Printf("Please enter path to an image (jpeg or png) you would like to use as your certificate holder\n")
-			fmt.Printf("(any image will do, but an image of you would be nice)\n")
-			fmt.Printf("image path (just press enter for a default image):")
-			imageOfMePath := ""
-			fmt.Scanln(&imageOfMePath)
+			imageOfMePath := opts.ImagePath
+			if len(imageOfMePath) == 0 && !opts.NonInteractive {
+				fmt.Fprintf(console, "Please enter path to an image (jpeg or png) you would like to use as your certificate holder\n")
+				fmt.Fprintf(console, "(any image will do, but an image of you would be nice)\n")
+				fmt.Fprintf(console, "image path (just press enter for a default image):")
+				fmt.Scanln(&imageOfMePath)
+			}
 
 			err = Generate(meCertPath, mePNGPath, meKeyPath, imageOfMePath)
 			if err != nil {
@@ -180,24 +301,69 @@ func InitKeychain(configDir string) error {
 		return err
 	}
 
-	certBytes, err := fetchCertBytes(myGmail)
+	if opts.NoPublish {
+		return nil
+	}
+
+	if opts.NonInteractive {
+		// Only fetch, uploading needs an oauth verification code from the user.
+		published, err := isPublished(kindiDirName)
+		if err != nil {
+			return err
+		}
+		if !published {
+			return fmt.Errorf("certificate not published, uploading it needs oauth: %w", ErrInputRequired)
+		}
+		return nil
+	}
+
+	return publishCert(kindiDirName)
+}
+
+// Publish uploads the certificate of an already initialized config directory
+// to picasaweb unless it is there already. It asks the user to authenticate with Google.
+func Publish(configDir string) error {
+	err := OpenKeychain(configDir)
 	if err != nil {
 		return err
 	}
 
-	goldenBytes, err := readAll(meCertPath)
+	kindiDirName, err := mkKindiDir(configDir)
 	if err != nil {
 		return err
 	}
 
+	return publishCert(kindiDirName)
+}
+
+func isPublished(kindiDirName string) (bool, error) {
+	certBytes, err := fetchCertBytes(myGmail)
+	if err != nil {
+		return false, err
+	}
+
+	goldenBytes, err := readAll(filepath.Join(kindiDirName, "me_cert.pem"))
+	if err != nil {
+		return false, err
+	}
+
 	goldenPemBlock, err := parsePem(goldenBytes)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(goldenPemBlock.Bytes, certBytes), nil
+}
+
+func publishCert(kindiDirName string) error {
+	published, err := isPublished(kindiDirName)
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Equal(goldenPemBlock.Bytes, certBytes) {
-		fmt.Println("Uploading your certificate")
-		err = uploadCertPNG(mePNGPath)
+	if !published {
+		fmt.Fprintln(console, "Uploading your certificate")
+		err = uploadCertPNG(filepath.Join(kindiDirName, "me_cert.png"))
 		if err != nil {
 			return err
 		}
@@ -206,32 +372,27 @@ func InitKeychain(configDir string) error {
 }
 
 func fetchImageOfMe(imageOfMePath string) (image.Image, error) {
-	var r io.Reader
-	var err error
-
-	if len(imageOfMePath) == 0 {
-		httpResponse, err := http.DefaultClient.Get("https://www.google.com/images/srpr/logo3w.png")
-		if err != nil {
-			return nil, err
-		}
-		defer httpResponse.Body.Close()
-		r = httpResponse.Body
-	} else {
-		f, err := os.Open(imageOfMePath)
-		if err != nil {
-			return nil, err
-		}
-		defer f.Close()
-		r = f
+	f, err := os.Open(imageOfMePath)
+	if err != nil {
+		return nil, err
 	}
-	m, _, err := image.Decode(r)
+	defer f.Close()
+
+	m, _, err := image.Decode(f)
 	if err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
-func Generate(certoutPath, pngoutPath, keyoutPath, imageOfMePath string) error {
+// certRedundancy is the error correction Generate embeds certificates with,
+// enough to survive image hosts flipping a few low bits.
+const certRedundancy = 16
+
+// Generate creates a new key and self-signed certificate and embeds the
+// certificate into a carrier image written to imageoutPath. The extension of
+// imageoutPath selects the format of the carrier, PNG if it is unknown.
+func Generate(certoutPath, imageoutPath, keyoutPath, imageOfMePath string) error {
 	priv, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
 		return err
@@ -271,21 +432,31 @@ func Generate(certoutPath, pngoutPath, keyoutPath, imageOfMePath string) error {
 	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 	keyOut.Close()
 
-	pngOut, err := os.OpenFile(pngoutPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	imageOut, err := os.OpenFile(imageoutPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 
-	img, err := fetchImageOfMe(imageOfMePath)
+	var img image.Image
+	if len(imageOfMePath) == 0 {
+		img, err = newIdenticon(&priv.PublicKey, len(derBytes))
+	} else {
+		img, err = fetchImageOfMe(imageOfMePath)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = EncodePNG(pngOut, derBytes, img)
+	c := carrierForPath(imageoutPath)
+	opts := &StegoOptions{Redundancy: certRedundancy}
+	img, err = fitImage(img, len(derBytes), c, opts)
+	if err == nil {
+		err = c.encode(imageOut, []PayloadItem{{Type: PayloadCertificate, Data: derBytes}}, img, opts)
+	}
 	if err != nil {
 		return err
 	}
-	pngOut.Close()
+	imageOut.Close()
 
 	return nil
 }
@@ -0,0 +1,153 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Metadata is the key-value section of the encrypted header of chunked
+// files, versions 2 to 4. It is authenticated along with the rest of the header. Keys other
+// than the ones below are kept, so newer versions can add their own.
+type Metadata map[string]string
+
+// Metadata keys kindi knows about.
+const (
+	MetaModTime     = "mtime"        // modification time of the original file, RFC 3339
+	MetaMode        = "mode"         // permission bits of the original file, octal
+	MetaContentType = "content-type" // MIME type of the original file
+	MetaNote        = "note"         // free text from the sender
+	MetaCreated     = "created"      // when the file was encrypted, RFC 3339
+	MetaExpires     = "expires"      // when the sender considers the file stale, RFC 3339
+)
+
+func (m Metadata) encode() []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := new(bytes.Buffer)
+	for _, k := range keys {
+		writeLengthEncoded(buf, []byte(k))
+		writeLengthEncoded(buf, []byte(m[k]))
+	}
+	return buf.Bytes()
+}
+
+func decodeMetadata(data []byte) (Metadata, error) {
+	m := make(Metadata)
+	buf := bytes.NewBuffer(data)
+
+	for buf.Len() > 0 {
+		k, err := readLengthEncoded(buf, "metadata key", maxMetadataKeySize)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readLengthEncoded(buf, "metadata value", maxMetadataSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(k) == 0 {
+			return nil, fmt.Errorf("metadata has an empty key")
+		}
+		if _, ok := m[string(k)]; ok {
+			return nil, fmt.Errorf("metadata key %q appears twice", k)
+		}
+		m[string(k)] = string(v)
+	}
+	return m, nil
+}
+
+// fileMetadata describes the file fi and when it is encrypted.
+func fileMetadata(fi os.FileInfo) Metadata {
+	m := make(Metadata)
+	m.setTime(MetaModTime, fi.ModTime())
+	m[MetaMode] = fmt.Sprintf("%04o", fi.Mode().Perm())
+	m.setTime(MetaCreated, time.Now())
+
+	contentType := mime.TypeByExtension(filepath.Ext(fi.Name()))
+	if len(contentType) > 0 {
+		m[MetaContentType] = contentType
+	}
+	return m
+}
+
+func (m Metadata) setTime(key string, t time.Time) {
+	m[key] = t.UTC().Format(time.RFC3339Nano)
+}
+
+// Time returns the time stored under key, and false if there is none or it
+// doesn't parse.
+func (m Metadata) Time(key string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, m[key])
+	return t, err == nil
+}
+
+// Mode returns the permission bits stored under MetaMode, and false if
+// there are none or they don't parse.
+func (m Metadata) Mode() (os.FileMode, bool) {
+	mode, err := strconv.ParseUint(m[MetaMode], 8, 32)
+	if err != nil {
+		return 0, false
+	}
+	return os.FileMode(mode).Perm(), true
+}
+
+// applyMetadata gives the decrypted file at path the permission bits and
+// modification time of the original. The permission bits come from the
+// sender, so the recipient's umask still applies and the file is never made
+// writable for group or others.
+func applyMetadata(path string, m Metadata) error {
+	mode, ok := m.Mode()
+	if ok {
+		err := os.Chmod(path, mode&^(umask()|0022))
+		if err != nil {
+			return err
+		}
+	}
+
+	mtime, ok := m.Time(MetaModTime)
+	if ok {
+		err := os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
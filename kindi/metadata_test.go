@@ -0,0 +1,144 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadataHeader(t *testing.T) {
+	envelope, sender, recipient := newTestEnvelope(t)
+	envelope.metadata = Metadata{
+		MetaNote:        "quarterly numbers, don't forward",
+		MetaContentType: "text/csv",
+		MetaMode:        "0640",
+		"x-future-key":  "kept as is",
+	}
+	envelope.metadata.setTime(MetaExpires, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	outbuffer := new(bytes.Buffer)
+	err := envelope.encrypt(outbuffer, bytes.NewBufferString("a,b\n1,2\n"), []byte("numbers.csv"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	encrypted := outbuffer.Bytes()
+
+	cr, err := openReader(bytes.NewReader(encrypted), int64(len(encrypted)), recipient, keychainFor(sender))
+	if err != nil {
+		t.Fatalf("failed to open reader %v", err)
+	}
+	if !reflect.DeepEqual(cr.Metadata(), envelope.metadata) {
+		t.Fatalf("expected metadata %v, got %v", envelope.metadata, cr.Metadata())
+	}
+
+	expires, ok := cr.Metadata().Time(MetaExpires)
+	if !ok || !expires.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected expiry %v", expires)
+	}
+
+	savedKey := myPrivateKey
+	myPrivateKey = recipient
+	info, err := inspect(bytes.NewReader(encrypted), int64(len(encrypted)), "numbers.csv.kindi")
+	myPrivateKey = savedKey
+	if err != nil {
+		t.Fatalf("failed to inspect %v", err)
+	}
+	if info.Metadata[MetaNote] != "quarterly numbers, don't forward" {
+		t.Fatalf("inspect shows metadata %v", info.Metadata)
+	}
+}
+
+func TestDecodeMetadataDuplicateKey(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		writeLengthEncoded(buf, []byte(MetaNote))
+		writeLengthEncoded(buf, []byte("hi"))
+	}
+
+	_, err := decodeMetadata(buf.Bytes())
+	if err == nil {
+		t.Fatalf("expected a duplicate metadata key to be rejected")
+	}
+}
+
+func TestApplyMetadata(t *testing.T) {
+	f, err := ioutil.TempFile("", "kindi-metadata")
+	if err != nil {
+		t.Fatalf("failed to create temp file %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	mtime := time.Date(2011, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := Metadata{MetaMode: "0600"}
+	m.setTime(MetaModTime, mtime)
+
+	err = applyMetadata(f.Name(), m)
+	if err != nil {
+		t.Fatalf("failed to apply metadata %v", err)
+	}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatalf("failed to stat %v", err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("expected mode 0600 and mtime %v, got %v and %v", mtime, fi.Mode().Perm(), fi.ModTime())
+	}
+}
+
+func TestApplyMetadataMode(t *testing.T) {
+	f, err := ioutil.TempFile("", "kindi-metadata")
+	if err != nil {
+		t.Fatalf("failed to create temp file %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	err = applyMetadata(f.Name(), Metadata{MetaMode: "0777"})
+	if err != nil {
+		t.Fatalf("failed to apply metadata %v", err)
+	}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatalf("failed to stat %v", err)
+	}
+	if fi.Mode().Perm()&0022 != 0 || fi.Mode().Perm()&umask() != 0 {
+		t.Fatalf("expected no group or other write bits and umask %04o applied, got %04o", umask(), fi.Mode().Perm())
+	}
+	if fi.Mode().Perm()&0700 != 0700 {
+		t.Fatalf("expected the owner bits to be kept, got %04o", fi.Mode().Perm())
+	}
+}
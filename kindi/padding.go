@@ -0,0 +1,118 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"fmt"
+)
+
+// Padding schemes recorded in the body parameters. Padding grows the
+// (compressed) plaintext to a size class before it is encrypted, so the file
+// size only tells which class the plaintext falls into.
+const (
+	paddingNone  = 0
+	paddingPadme = 1
+	paddingPow2  = 2
+)
+
+var paddingNames = []string{
+	paddingNone:  "none",
+	paddingPadme: "padme",
+	paddingPow2:  "pow2",
+}
+
+// Chunks of padded files start with the number of plaintext bytes they
+// carry (4 bytes), the rest of the chunk is padding.
+const paddedChunkPrefix = 4
+
+// PaddingSchemes returns the names EncryptOptions.Padding accepts.
+func PaddingSchemes() []string {
+	return append([]string(nil), paddingNames...)
+}
+
+func paddingByName(name string) (byte, error) {
+	if name == "" {
+		return paddingNone, nil
+	}
+	for i, n := range paddingNames {
+		if n == name {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown padding %q, want one of %v", name, paddingNames)
+}
+
+func paddingName(scheme byte) string {
+	if int(scheme) < len(paddingNames) {
+		return paddingNames[scheme]
+	}
+	return fmt.Sprintf("unknown (%d)", scheme)
+}
+
+// paddedSize returns the size length bytes are padded to with scheme.
+func paddedSize(scheme byte, length uint64) uint64 {
+	switch scheme {
+	case paddingPadme:
+		return padme(length)
+	case paddingPow2:
+		return nextPowerOfTwo(length)
+	}
+	return length
+}
+
+func log2(n uint64) uint {
+	var rv uint
+	for n > 1 {
+		n >>= 1
+		rv++
+	}
+	return rv
+}
+
+// padme rounds length up so that only the top log2(log2(length))+1 bits
+// may be set. That wastes at most 12% and leaks O(log log length) bits
+// (PADMÉ, Nikitin et al., "Reducing Metadata Leakage from Encrypted Files
+// and Communication with PURBs", 2019).
+func padme(length uint64) uint64 {
+	if length < 2 {
+		return length
+	}
+
+	e := log2(length)
+	s := log2(uint64(e)) + 1
+	mask := uint64(1)<<(e-s) - 1
+	return (length + mask) &^ mask
+}
+
+func nextPowerOfTwo(length uint64) uint64 {
+	if length < 2 {
+		return length
+	}
+	return uint64(1) << (log2(length-1) + 1)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+	for _, c := range []struct {
+		scheme         byte
+		length, padded uint64
+	}{
+		{paddingNone, 1000, 1000},
+		{paddingPadme, 0, 0},
+		{paddingPadme, 1, 1},
+		{paddingPadme, 9, 10},
+		{paddingPadme, 1000, 1024},
+		{paddingPadme, 1025, 1088},
+		{paddingPadme, 1 << 30, 1 << 30},
+		{paddingPow2, 0, 0},
+		{paddingPow2, 1, 1},
+		{paddingPow2, 3, 4},
+		{paddingPow2, 1024, 1024},
+		{paddingPow2, 1025, 2048},
+	} {
+		if got := paddedSize(c.scheme, c.length); got != c.padded {
+			t.Fatalf("%s padding of %d: expected %d, got %d", paddingName(c.scheme), c.length, c.padded, got)
+		}
+	}
+
+	for length := uint64(2); length < 1<<20; length = length*3/2 + 1 {
+		padded := padme(length)
+		if padded < length || float64(padded-length) > 0.12*float64(length) {
+			t.Fatalf("padme(%d) = %d is out of bounds", length, padded)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, scheme := range []byte{paddingPadme, paddingPow2} {
+		sizes := make(map[int]int)
+
+		for _, n := range []int{0, 1, 59, 60, 61, 500, 1000, 1020} {
+			payload := make([]byte, n)
+			rand.Read(payload)
+
+			envelope, sender, recipient := newTestEnvelope(t)
+			envelope.chunkSize = 64
+			envelope.padding = scheme
+
+			outbuffer := new(bytes.Buffer)
+			err := envelope.encrypt(outbuffer, bytes.NewReader(payload), []byte("secret.bin"))
+			if err != nil {
+				t.Fatalf("%s, %d bytes: failed to encrypt %v", paddingName(scheme), n, err)
+			}
+			encrypted := outbuffer.Bytes()
+			sizes[n] = len(encrypted)
+
+			keychain := keychainFor(sender)
+
+			roundtripbuffer := new(bytes.Buffer)
+			err = decrypt(roundtripbuffer, bytes.NewReader(encrypted), recipient, keychain)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: failed to decrypt %v", paddingName(scheme), n, err)
+			}
+			if !bytes.Equal(roundtripbuffer.Bytes(), payload) {
+				t.Fatalf("%s, %d bytes: decrypted payload different from original payload", paddingName(scheme), n)
+			}
+
+			cr, err := openReader(bytes.NewReader(encrypted), int64(len(encrypted)), recipient, keychain)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: failed to open reader %v", paddingName(scheme), n, err)
+			}
+			if cr.Size() != int64(n) {
+				t.Fatalf("%s, %d bytes: reader reports size %d", paddingName(scheme), n, cr.Size())
+			}
+			all, err := ioutil.ReadAll(cr)
+			if err != nil || !bytes.Equal(all, payload) {
+				t.Fatalf("%s, %d bytes: reader returned wrong plaintext (%v)", paddingName(scheme), n, err)
+			}
+		}
+
+		// 1000 and 1020 bytes are in the same size class for both schemes
+		if sizes[1000] != sizes[1020] {
+			t.Fatalf("%s: 1000 and 1020 bytes encrypted to %d and %d bytes", paddingName(scheme), sizes[1000], sizes[1020])
+		}
+	}
+}
+
+func TestPaddingTampering(t *testing.T) {
+	payload := make([]byte, 300)
+	rand.Read(payload)
+
+	envelope, sender, recipient := newTestEnvelope(t)
+	envelope.chunkSize = 64
+	envelope.padding = paddingPow2
+
+	outbuffer := new(bytes.Buffer)
+	err := envelope.encrypt(outbuffer, bytes.NewReader(payload), []byte("secret.bin"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	encrypted := outbuffer.Bytes()
+
+	// drop a padding chunk: 300 bytes pad to 512, that is 9 chunks of 60
+	stride := chunkHeaderSize + 64 + gcmTagSize
+	trailer := trailerSize + gcmTagSize
+	body := len(encrypted) - trailer - 8*stride - (chunkHeaderSize + paddedChunkPrefix + 512 - 8*60 + gcmTagSize)
+	dropped := append([]byte(nil), encrypted[:body+6*stride]...)
+	dropped = append(dropped, encrypted[body+7*stride:]...)
+
+	err = decrypt(ioutil.Discard, bytes.NewReader(dropped), recipient, keychainFor(sender))
+	if err == nil {
+		t.Fatalf("expected decrypt to fail without a padding chunk")
+	}
+	_, err = openReader(bytes.NewReader(dropped), int64(len(dropped)), recipient, keychainFor(sender))
+	if err == nil {
+		t.Fatalf("expected reader to fail without a padding chunk")
+	}
+}
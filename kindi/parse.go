@@ -0,0 +1,102 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMalformed is matched (with errors.Is) by every *FormatError.
+var ErrMalformed = errors.New("malformed kindi file")
+
+// FormatError reports a .kindi file, or part of one, that doesn't parse.
+type FormatError struct {
+	Field string // what was being read
+	Err   error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrMalformed, e.Field, e.Err)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FormatError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// Maximum sizes of the length encoded fields. They are far above anything
+// kindi writes and only keep a damaged or hostile file from making it
+// allocate arbitrary amounts of memory.
+const (
+	maxHeaderSize      = 1 << 20
+	maxWrappedKeySize  = 2048 // RSA keys up to 16384 bits
+	maxEmailSize       = 320
+	maxSignatureSize   = 2048
+	maxFilenameSize    = 4096
+	maxParamsSize      = 4096
+	maxMetadataSize    = maxHeaderSize
+	maxMetadataKeySize = 256
+)
+
+// readFull is io.ReadFull reporting any short read as a *FormatError.
+func readFull(r io.Reader, buf []byte, field string) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return &FormatError{Field: field, Err: err}
+	}
+	return err
+}
+
+// readHeaderAndHash reads the length encoded header and header hmac that
+// follow the magic of a .kindi file.
+func readHeaderAndHash(r io.Reader) ([]byte, []byte, error) {
+	header, err := readLengthEncoded(r, "header", maxHeaderSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headerHash, err := readLengthEncoded(r, "header hmac", sha256.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(headerHash) != sha256.Size {
+		return nil, nil, &FormatError{Field: "header hmac", Err: fmt.Errorf("%d bytes, want %d", len(headerHash), sha256.Size)}
+	}
+
+	return header, headerHash, nil
+}
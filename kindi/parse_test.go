@@ -0,0 +1,233 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// sealHeaderFields builds a header around fields, the plaintext of the
+// encrypted header part, with a valid hmac, so tests reach the parser.
+func sealHeaderFields(t testing.TB, recipient *rsa.PublicKey, fields []byte) ([]byte, []byte) {
+	symmetricKey := make([]byte, 32)
+	rand.Read(symmetricKey)
+
+	wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, recipient, symmetricKey, nil)
+	if err != nil {
+		t.Fatalf("failed to wrap key %v", err)
+	}
+
+	header := new(bytes.Buffer)
+	writeLengthEncoded(header, wrapped)
+
+	stream, hmacHash, err := newCipherStream(symmetricKey)
+	if err != nil {
+		t.Fatalf("failed to create cipher %v", err)
+	}
+
+	encrypted := make([]byte, len(fields))
+	stream.XORKeyStream(encrypted, fields)
+	hmacHash.Write(encrypted)
+	header.Write(encrypted)
+
+	return header.Bytes(), hmacHash.Sum(nil)
+}
+
+func headerFieldsBytes(extra ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	writeLengthEncoded(buf, []byte("foo@gmail.com"))
+	writeLengthEncoded(buf, make([]byte, 128))
+	writeLengthEncoded(buf, []byte("foo.txt"))
+	for _, e := range extra {
+		buf.Write(e)
+	}
+	return buf.Bytes()
+}
+
+func TestStrictParsing(t *testing.T) {
+	_, sender, recipient := newTestEnvelope(t)
+	keychain := keychainFor(sender)
+
+	huge := make([]byte, 8)
+	binary.BigEndian.PutUint64(huge, 1<<62)
+	negative := make([]byte, 8)
+	binary.BigEndian.PutUint64(negative, 1<<63)
+
+	for name, fields := range map[string][]byte{
+		"huge filename":    append(headerFieldsBytes()[:len(headerFieldsBytes())-15], huge...),
+		"trailing garbage": headerFieldsBytes(make([]byte, 20), []byte{1}),
+		"short sender":     []byte{0, 0, 0, 0, 0, 0, 0, 9, 'f', 'o', 'o'},
+	} {
+		header, headerHash := sealHeaderFields(t, &recipient.PublicKey, fields)
+		_, _, err := verifyHeader(formatVersion1, header, headerHash, recipient, keychain)
+		if !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%s: expected ErrMalformed, got %v", name, err)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":            nil,
+		"magic only":       []byte("KINDI\x02"),
+		"unknown version":  []byte("KINDI\x07\x00\x00\x00\x00\x00\x00\x00\x00"),
+		"huge header":      append([]byte("KINDI\x02"), huge...),
+		"negative header":  append([]byte("KINDI\x02"), negative...),
+		"truncated header": append([]byte("KINDI\x02\x00\x00\x00\x00\x00\x00\x01\x00"), "short"...),
+	} {
+		err := decrypt(ioutil.Discard, bytes.NewReader(data), recipient, keychain)
+		if !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%s: expected ErrMalformed, got %v", name, err)
+		}
+	}
+
+	encrypted, keychain, recipient := encryptChunked(t, []byte("strict"), 64)
+	err := decrypt(ioutil.Discard, bytes.NewReader(append(encrypted, 0)), recipient, keychain)
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed for data after the trailer, got %v", err)
+	}
+
+	armored := new(bytes.Buffer)
+	aw, _ := newArmorWriter(armored)
+	aw.Write(encrypted)
+	aw.Close()
+	armored.WriteString("\n\n")
+	err = decrypt(ioutil.Discard, bytes.NewReader(armored.Bytes()), recipient, keychain)
+	if err != nil {
+		t.Fatalf("expected whitespace after the armor to be fine, got %v", err)
+	}
+	armored.WriteString("-- \nsent from my phone\n")
+	err = decrypt(ioutil.Discard, bytes.NewReader(armored.Bytes()), recipient, keychain)
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected ErrMalformed for data after the armor, got %v", err)
+	}
+}
+
+func TestTruncatedBody(t *testing.T) {
+	payload := []byte("strict")
+	encrypted, keychain, recipient := encryptChunked(t, payload, 64)
+	sealedTrailer := trailerSize + gcmTagSize
+	body := len(encrypted) - sealedTrailer - (chunkHeaderSize + len(payload) + gcmTagSize)
+
+	truncated := encrypted[:body+chunkHeaderSize]
+	_, err := inspect(bytes.NewReader(truncated), int64(len(truncated)), "strict.kindi")
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("inspect: expected ErrMalformed, got %v", err)
+	}
+	_, err = openReader(bytes.NewReader(truncated), int64(len(truncated)), recipient, keychain)
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("openReader: expected ErrMalformed, got %v", err)
+	}
+
+	badLength := append([]byte(nil), encrypted...)
+	binary.BigEndian.PutUint32(badLength[body:], chunkFinalFlag|1000)
+	err = decrypt(ioutil.Discard, bytes.NewReader(badLength), recipient, keychain)
+	if !errors.Is(err, ErrMalformed) || errors.Is(err, ErrMACMismatch) {
+		t.Fatalf("expected ErrMalformed for a bad chunk length, got %v", err)
+	}
+}
+
+func TestDecodePNGTooLarge(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, 10, 10)))
+
+	// claim 100000x100000 pixels in IHDR, png.Decode would try to allocate them
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:], 100000)
+	binary.BigEndian.PutUint32(data[20:], 100000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	_, err := DecodePNG(bytes.NewReader(data))
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("expected ErrImageTooLarge, got %v", err)
+	}
+}
+
+func FuzzDecrypt(f *testing.F) {
+	envelope, sender, recipient := newTestEnvelope(f)
+	envelope.chunkSize = 64
+	keychain := keychainFor(sender)
+
+	for _, payload := range []string{"", "hello", strings.Repeat("kindi", 40)} {
+		buf := new(bytes.Buffer)
+		envelope.encrypt(buf, strings.NewReader(payload), []byte("fuzz.txt"))
+		f.Add(buf.Bytes())
+	}
+
+	buf := new(bytes.Buffer)
+	encryptVersion1(envelope, buf, strings.NewReader("hello"), []byte("fuzz.txt"))
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decrypt(ioutil.Discard, bytes.NewReader(data), recipient, keychain)
+	})
+}
+
+func FuzzDecryptHeader(f *testing.F) {
+	_, sender, recipient := newTestEnvelope(f)
+	keychain := keychainFor(sender)
+
+	params := (&bodyParams{chunkSize: defaultChunkSize, padding: paddingPadme}).encode()
+	metadata := Metadata{MetaNote: "hi", MetaMode: "0644"}.encode()
+	paramsField, metadataField := new(bytes.Buffer), new(bytes.Buffer)
+	writeLengthEncoded(paramsField, params)
+	writeLengthEncoded(metadataField, metadata)
+
+	f.Add(headerFieldsBytes())
+	f.Add(headerFieldsBytes(paramsField.Bytes(), metadataField.Bytes()))
+
+	f.Fuzz(func(t *testing.T, fields []byte) {
+		header, headerHash := sealHeaderFields(t, &recipient.PublicKey, fields)
+		verifyHeader(formatVersion1, header, headerHash, recipient, keychain)
+	})
+}
+
+func FuzzDecodePNG(f *testing.F) {
+	m := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	buf := new(bytes.Buffer)
+	EncodePNG(buf, []byte("certificate"), m)
+	f.Add(buf.Bytes())
+
+	buf = new(bytes.Buffer)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodePNG(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrase files (format version 3) are chunked like version 2 files, but
+// their symmetric key is derived from a passphrase with scrypt rather than
+// wrapped for a recipient, for people who have no kindi key. The header starts with the
+// key derivation parameters where version 2 has the wrapped key:
+//
+//	kdf (1 byte, kdfScrypt), log2 N (1 byte), r (1 byte), p (1 byte), salt (16 bytes)
+//
+// Sender and signature are empty, the passphrase is all that authenticates
+// the file.
+const (
+	kdfScrypt        = 1
+	kdfParamsSize    = 4 + scryptSaltSize
+	scryptSaltSize   = 16
+	scryptLogN       = 18 // 256 MiB and about a second with r = 8
+	scryptR          = 8
+	scryptP          = 1
+	minScryptLogN    = 10
+	maxScryptMemory  = 1 << 30
+	maxKDFParamsSize = 256
+)
+
+var (
+	// ErrPassphrase is returned for passphrase files the passphrase doesn't
+	// open, which is also what a tampered header looks like.
+	ErrPassphrase = errors.New("wrong passphrase")
+
+	// ErrPassphraseRequired is returned when a passphrase file is opened
+	// with a key; it wraps ErrNotRecipient.
+	ErrPassphraseRequired = fmt.Errorf("%w: file is encrypted with a passphrase", ErrNotRecipient)
+)
+
+type kdfParams struct {
+	logN, r, p byte
+	salt       []byte
+}
+
+// newKDFParams returns scrypt parameters with cost 2^logN and a fresh salt.
+func newKDFParams(logN byte) (*kdfParams, error) {
+	salt := make([]byte, scryptSaltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &kdfParams{logN: logN, r: scryptR, p: scryptP, salt: salt}, nil
+}
+
+func (k *kdfParams) encode() []byte {
+	return append([]byte{kdfScrypt, k.logN, k.r, k.p}, k.salt...)
+}
+
+// decodeKDFParams parses encoded key derivation parameters, refusing any
+// that would take more than maxScryptMemory to evaluate.
+func decodeKDFParams(data []byte) (*kdfParams, error) {
+	if len(data) != kdfParamsSize {
+		return nil, fmt.Errorf("%d bytes, want %d", len(data), kdfParamsSize)
+	}
+	if data[0] != kdfScrypt {
+		return nil, fmt.Errorf("unknown key derivation function %d", data[0])
+	}
+
+	k := &kdfParams{logN: data[1], r: data[2], p: data[3], salt: data[4:]}
+	if k.logN < minScryptLogN || k.logN > 30 || k.r == 0 || k.p == 0 || k.p > 16 {
+		return nil, fmt.Errorf("scrypt parameters log2 N %d, r %d, p %d out of range", k.logN, k.r, k.p)
+	}
+	if 128*int64(k.r)<<k.logN > maxScryptMemory {
+		return nil, fmt.Errorf("scrypt parameters log2 N %d, r %d need more than %d bytes", k.logN, k.r, maxScryptMemory)
+	}
+	return k, nil
+}
+
+func (k *kdfParams) deriveKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, k.salt, 1<<k.logN, int(k.r), int(k.p), 32)
+}
+
+func (k *kdfParams) String() string {
+	return fmt.Sprintf("scrypt N=2^%d r=%d p=%d", k.logN, k.r, k.p)
+}
+
+func newPassphraseEnvelope(passphrase []byte) (*envelope, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+
+	kdf, err := newKDFParams(scryptLogN)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{passphrase: passphrase, kdf: kdf}, nil
+}
+
+// passphraseOpener opens the headers of passphrase files with passphrase.
+func passphraseOpener(passphrase []byte) headerOpener {
+	return func(version int, header, headerHash []byte) ([]byte, *headerFields, error) {
+		if version != formatVersion3 {
+			return nil, nil, fmt.Errorf("%w: file is encrypted for a key, not with a passphrase", ErrNotRecipient)
+		}
+
+		buf := bytes.NewBuffer(header)
+
+		encoded, err := readLengthEncoded(buf, "key derivation parameters", maxKDFParamsSize)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		kdf, err := decodeKDFParams(encoded)
+		if err != nil {
+			return nil, nil, &FormatError{Field: "key derivation parameters", Err: err}
+		}
+
+		symmetricKey, err := kdf.deriveKey(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		prefix := authenticatedPrefix(version, header[:len(header)-buf.Len()])
+		fields, err := openHeaderFields(buf, prefix, headerHash, symmetricKey)
+		if errors.Is(err, ErrMACMismatch) {
+			return nil, nil, ErrPassphrase
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(fields.senderEmail) > 0 || len(fields.sig) > 0 {
+			return nil, nil, &FormatError{Field: "sender", Err: errors.New("passphrase files have no sender")}
+		}
+		return symmetricKey, fields, nil
+	}
+}
+
+// EncryptFileWithPassphrase encrypts the file at path like EncryptFile, but
+// with a key derived from passphrase, so anybody who knows it can decrypt the
+// file with DecryptFileWithPassphrase, with or without a kindi key. The
+// Result has no sender or recipients.
+func EncryptFileWithPassphrase(passphrase []byte, path string, opts *EncryptOptions) (*Result, error) {
+	return encryptFile(path, opts, func(*EncryptOptions) (*envelope, *Result, error) {
+		envelope, err := newPassphraseEnvelope(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return envelope, new(Result), nil
+	})
+}
+
+// DecryptFileWithPassphrase decrypts the passphrase file at path like
+// DecryptFile. It fails with ErrPassphrase if passphrase is wrong.
+func DecryptFileWithPassphrase(path string, passphrase []byte) (*Result, error) {
+	return decryptFile(path, passphrase)
+}
+
+// NeedsPassphrase reports whether the .kindi file at path is a passphrase
+// file, which DecryptFile can't open. It needs no keychain.
+func NeedsPassphrase(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	version, _, err := readVersion(dearmor(f))
+	if err != nil {
+		return false, err
+	}
+	return version == formatVersion3, nil
+}
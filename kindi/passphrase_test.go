@@ -0,0 +1,213 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptPassphrase encrypts payload with passphrase, with the cheapest
+// scrypt parameters decodeKDFParams accepts.
+func encryptPassphrase(t *testing.T, payload, passphrase []byte) []byte {
+	envelope, err := newPassphraseEnvelope(passphrase)
+	if err != nil {
+		t.Fatalf("failed to create envelope %v", err)
+	}
+	envelope.kdf.logN = minScryptLogN
+	envelope.chunkSize = 64
+
+	buf := new(bytes.Buffer)
+	err = envelope.encrypt(buf, bytes.NewReader(payload), []byte("secret.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decryptPassphrase(encrypted, passphrase []byte) ([]byte, error) {
+	version, symmetricKey, headerHash, fields, r, err := readHeader(bytes.NewReader(encrypted), passphraseOpener(passphrase))
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(bytes.Buffer)
+	err = decryptBodyVersion(out, r, version, symmetricKey, headerHash, fields)
+	return out.Bytes(), err
+}
+
+func TestPassphrase(t *testing.T) {
+	payload := []byte("the quick brown fox jumps over the lazy dog, more than once")
+	encrypted := encryptPassphrase(t, payload, []byte("correct horse battery staple"))
+
+	if !bytes.HasPrefix(encrypted, append(fileMagic[:len(fileMagic):len(fileMagic)], formatVersion3)) {
+		t.Fatalf("expected a version 3 file")
+	}
+
+	out, err := decryptPassphrase(encrypted, []byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("decrypted payload different from original payload")
+	}
+
+	_, err = decryptPassphrase(encrypted, []byte("correct horse battery stapler"))
+	if !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+
+	_, sender, recipient := newTestEnvelope(t)
+	err = decrypt(ioutil.Discard, bytes.NewReader(encrypted), recipient, keychainFor(sender))
+	if !errors.Is(err, ErrPassphraseRequired) || !errors.Is(err, ErrNotRecipient) {
+		t.Fatalf("expected ErrPassphraseRequired, got %v", err)
+	}
+
+	keyed, _, _ := encryptChunked(t, payload, 64)
+	_, err = decryptPassphrase(keyed, []byte("correct horse battery staple"))
+	if !errors.Is(err, ErrNotRecipient) {
+		t.Fatalf("expected a passphrase not to open a file encrypted for a key, got %v", err)
+	}
+
+	info, err := inspect(bytes.NewReader(encrypted), int64(len(encrypted)), "secret.txt.kindi")
+	if err != nil {
+		t.Fatalf("failed to inspect %v", err)
+	}
+	if info.Version != formatVersion3 || info.KDF != "scrypt N=2^10 r=8 p=1" || info.WrappedKeySize != 0 || info.EncryptedBodySize <= 0 {
+		t.Fatalf("unexpected inspect result %+v", info)
+	}
+}
+
+func TestDecodeKDFParams(t *testing.T) {
+	salt := make([]byte, scryptSaltSize)
+
+	for _, tc := range []struct {
+		data []byte
+		ok   bool
+	}{
+		{append([]byte{kdfScrypt, scryptLogN, scryptR, scryptP}, salt...), true},
+		{append([]byte{kdfScrypt, 20, 8, 1}, salt...), true},
+		{append([]byte{kdfScrypt, 21, 8, 1}, salt...), false}, // 2 GiB
+		{append([]byte{kdfScrypt, 4, 8, 1}, salt...), false},
+		{append([]byte{kdfScrypt, 14, 0, 1}, salt...), false},
+		{append([]byte{2, 14, 8, 1}, salt...), false},
+		{[]byte{kdfScrypt, 14, 8, 1}, false},
+	} {
+		_, err := decodeKDFParams(tc.data)
+		if (err == nil) != tc.ok {
+			t.Fatalf("decodeKDFParams(%x): expected ok %v, got %v", tc.data[:4], tc.ok, err)
+		}
+	}
+}
+
+func TestDecryptFileWithPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kindi-passphrase")
+	if err != nil {
+		t.Fatalf("failed to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secret.txt.kindi")
+	err = ioutil.WriteFile(path, encryptPassphrase(t, []byte("hello"), []byte("open sesame")), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+
+	needs, err := NeedsPassphrase(path)
+	if err != nil || !needs {
+		t.Fatalf("expected NeedsPassphrase to be true, got %v, %v", needs, err)
+	}
+
+	_, err = DecryptFileWithPassphrase(path, []byte("open barley"))
+	if !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "secret.txt"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no output for a wrong passphrase, got %v", err)
+	}
+
+	res, err := DecryptFileWithPassphrase(path, []byte("open sesame"))
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if res.Output != filepath.Join(dir, "secret.txt") || len(res.Sender) > 0 || len(res.Recipients) > 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	data, err := ioutil.ReadFile(res.Output)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected hello, got %q, %v", data, err)
+	}
+}
+
+func TestDecryptFileRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kindi-relative")
+	if err != nil {
+		t.Fatalf("failed to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "secret.txt.kindi"), encryptPassphrase(t, []byte("hello"), []byte("open sesame")), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory %v", err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatalf("failed to change directory %v", err)
+	}
+	defer os.Chdir(wd)
+
+	// the temporary output must go next to the input, not to TMPDIR, which
+	// may be on another file system
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+	res, err := DecryptFileWithPassphrase("secret.txt.kindi", []byte("open sesame"))
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if res.Output != "secret.txt" {
+		t.Fatalf("expected output secret.txt, got %s", res.Output)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "secret.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected hello, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Images carry a frame of typed items:
+//
+//	preamble: magic "KNDI", version (1 byte), layout (1 byte)
+//	item count (1 byte)
+//	per item: type (1 byte), length (4 bytes), data, CRC32 of type, length and data (4 bytes)
+//
+// The preamble is always embedded with the default layout, everything after
+// it with the layout the preamble names. The magic lets DecodePNG tell images
+// without a payload from damaged ones, the per item checksum catches damage.
+// Version 1 frames have no layout byte and use the default layout throughout.
+//
+// The top 3 bits of the layout byte select Reed-Solomon protection for
+// everything after the preamble, 8 parity bytes per codeword for each step.
+// A protected frame continues with a codeword holding the length of the
+// unprotected rest (4 bytes), then the rest in codewords of up to 255 bytes.
+var frameMagic = []byte("KNDI")
+
+const (
+	frameVersion         = 2
+	framePreambleSize    = 4 + 1 + 1
+	frameHeaderSize      = framePreambleSize + 1
+	frameItemHeaderSize  = 1 + 4
+	frameItemTrailerSize = 4
+	maxFrameItems        = 255
+
+	frameParityShift = 5
+	frameParityStep  = 8
+	maxFrameParity   = 7 * frameParityStep
+	frameLengthSize  = 4
+)
+
+// layoutSetter is implemented by carriers that can change how they embed
+// bits after the frame preamble.
+type layoutSetter interface {
+	setLayout(l lsbLayout) error
+}
+
+// lener is implemented by carriers that know how many bytes they have left.
+type lener interface {
+	Len() int
+}
+
+// PayloadType tells what an embedded item is.
+type PayloadType byte
+
+const (
+	PayloadCertificate PayloadType = 1
+	PayloadRevocation  PayloadType = 2
+	PayloadProfile     PayloadType = 3
+	PayloadEnvelope    PayloadType = 4
+)
+
+func (t PayloadType) String() string {
+	switch t {
+	case PayloadCertificate:
+		return "certificate"
+	case PayloadRevocation:
+		return "revocation"
+	case PayloadProfile:
+		return "profile"
+	case PayloadEnvelope:
+		return "envelope"
+	}
+	return fmt.Sprintf("payload type %d", byte(t))
+}
+
+// PayloadItem is one typed item embedded in an image.
+type PayloadItem struct {
+	Type PayloadType
+	Data []byte
+}
+
+// ErrPayloadCorrupt is returned (wrapped) when an image carries a kindi
+// payload that is damaged.
+var ErrPayloadCorrupt = errors.New("kindi payload in image is corrupt")
+
+// frameSize returns the number of bytes writeFrame needs for items without
+// error correction.
+func frameSize(items []PayloadItem) int {
+	rv := frameHeaderSize
+	for _, item := range items {
+		rv += frameItemHeaderSize + len(item.Data) + frameItemTrailerSize
+	}
+	return rv
+}
+
+// protectedSize returns the number of bytes n bytes take with parity bytes
+// of error correction per codeword.
+func protectedSize(n, parity int) int {
+	if parity == 0 {
+		return n
+	}
+	data := rsCodewordSize - parity
+	return frameLengthSize + parity + n + (n+data-1)/data*parity
+}
+
+// unprotectedSize is the inverse of protectedSize, it returns the largest n
+// for which protectedSize(n, parity) doesn't exceed size.
+func unprotectedSize(size, parity int) int {
+	if parity == 0 {
+		return size
+	}
+	size -= frameLengthSize + parity
+	n := size / rsCodewordSize * (rsCodewordSize - parity)
+	if rest := size % rsCodewordSize; rest > parity {
+		n += rest - parity
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func checkParity(parity int) error {
+	if parity < 0 || parity > maxFrameParity || parity%frameParityStep != 0 {
+		return fmt.Errorf("redundancy must be a multiple of %d between 0 and %d, got %d", frameParityStep, maxFrameParity, parity)
+	}
+	return nil
+}
+
+// protect returns data as a protected frame continues after the preamble.
+func protect(data []byte, parity int) []byte {
+	rv := make([]byte, 0, protectedSize(len(data), parity))
+
+	length := make([]byte, frameLengthSize)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	rv = append(rv, rsEncode(length, parity)...)
+
+	chunk := rsCodewordSize - parity
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		rv = append(rv, rsEncode(data[:n], parity)...)
+		data = data[n:]
+	}
+	return rv
+}
+
+// recoverProtected reads what protect wrote from r, repairing what it can.
+// It returns the data and the number of bytes it repaired. Like readFrame it
+// bounds the data by maxSize and the bytes left in r.
+func recoverProtected(r io.Reader, parity, maxSize int) ([]byte, int, error) {
+	lengthCodeword := make([]byte, frameLengthSize+parity)
+	_, err := io.ReadFull(r, lengthCodeword)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrPayloadCorrupt, err)
+	}
+	corrected, err := rsDecode(lengthCodeword, parity)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: frame length: %v", ErrPayloadCorrupt, err)
+	}
+
+	n := int64(binary.BigEndian.Uint32(lengthCodeword))
+	size := int64(protectedSize(int(n), parity) - len(lengthCodeword))
+	if l, ok := r.(lener); ok && size > int64(l.Len()) {
+		return nil, 0, fmt.Errorf("%w: frame claims %d bytes, only %d left in image", ErrPayloadCorrupt, size, l.Len())
+	}
+	if n > int64(maxSize) {
+		return nil, 0, fmt.Errorf("%w: frame is %d bytes, maximum is %d bytes", ErrPayloadTooLarge, n, maxSize)
+	}
+
+	encoded := make([]byte, size)
+	_, err = io.ReadFull(r, encoded)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrPayloadCorrupt, err)
+	}
+
+	data := make([]byte, 0, n)
+	for i := 0; len(encoded) > 0; i++ {
+		k := rsCodewordSize
+		if k > len(encoded) {
+			k = len(encoded)
+		}
+		c, err := rsDecode(encoded[:k], parity)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: codeword %d: %v", ErrPayloadCorrupt, i, err)
+		}
+		corrected += c
+		data = append(data, encoded[:k-parity]...)
+		encoded = encoded[k:]
+	}
+	return data, corrected, nil
+}
+
+// writeFrame writes items to w, embedded with layout and protected by
+// parity bytes of error correction per codeword.
+func writeFrame(w io.Writer, items []PayloadItem, layout lsbLayout, parity int) error {
+	if len(items) > maxFrameItems {
+		return fmt.Errorf("can't embed more than %d items, got %d", maxFrameItems, len(items))
+	}
+	err := checkParity(parity)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, frameSize(items)))
+	buf.Write(frameMagic)
+	buf.WriteByte(frameVersion)
+	buf.WriteByte(layout.encode() | byte(parity/frameParityStep)<<frameParityShift)
+
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if ls, ok := w.(layoutSetter); ok {
+		err = ls.setLayout(layout)
+		if err != nil {
+			return err
+		}
+	} else if layout != defaultLayout {
+		return fmt.Errorf("carrier doesn't support layout %v", layout)
+	}
+
+	buf.Reset()
+	buf.WriteByte(byte(len(items)))
+
+	for _, item := range items {
+		start := buf.Len()
+		buf.WriteByte(byte(item.Type))
+		binary.Write(buf, binary.BigEndian, uint32(len(item.Data)))
+		buf.Write(item.Data)
+		binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()[start:]))
+	}
+
+	body := buf.Bytes()
+	if parity > 0 {
+		body = protect(body, parity)
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// readFrame reads the items writeFrame wrote and returns them with the number
+// of bytes error correction repaired. maxSize bounds the size of each item,
+// as does the number of bytes left in r if r implements lener. It returns
+// ErrNoPayload itself, unwrapped, if r doesn't start with the frame magic.
+func readFrame(r io.Reader, maxSize int) ([]PayloadItem, int, error) {
+	preamble := make([]byte, len(frameMagic)+1)
+	_, err := io.ReadFull(r, preamble)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrNoPayload, err)
+	}
+
+	if !bytes.Equal(preamble[:len(frameMagic)], frameMagic) {
+		return nil, 0, ErrNoPayload
+	}
+
+	layout := defaultLayout
+	parity := 0
+
+	switch preamble[len(frameMagic)] {
+	case 1:
+	case frameVersion:
+		b := make([]byte, 1)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrPayloadCorrupt, err)
+		}
+		parity = int(b[0]>>frameParityShift) * frameParityStep
+		layout, err = decodeLayout(b[0] & (1<<frameParityShift - 1))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrPayloadCorrupt, err)
+		}
+
+		// the items start at the next whole pixel in the new layout
+		if ls, ok := r.(layoutSetter); ok {
+			err = ls.setLayout(layout)
+			if err != nil {
+				return nil, 0, err
+			}
+		} else if layout != defaultLayout {
+			return nil, 0, fmt.Errorf("%w: carrier doesn't support layout %v", ErrPayloadCorrupt, layout)
+		}
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported frame version %d", ErrPayloadCorrupt, preamble[len(frameMagic)])
+	}
+
+	corrected := 0
+	if parity > 0 {
+		// the items of a frame can't get bigger than this
+		limit := 1 + maxFrameItems*(frameItemHeaderSize+maxSize+frameItemTrailerSize)
+		var data []byte
+		data, corrected, err = recoverProtected(r, parity, limit)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	items, err := readItems(r, maxSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return items, corrected, nil
+}
+
+// readItems reads the item count and items of a frame.
+func readItems(r io.Reader, maxSize int) ([]PayloadItem, error) {
+	countByte := make([]byte, 1)
+	_, err := io.ReadFull(r, countByte)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPayloadCorrupt, err)
+	}
+	count := int(countByte[0])
+
+	items := make([]PayloadItem, 0, count)
+	for i := 0; i < count; i++ {
+		itemHeader := make([]byte, frameItemHeaderSize)
+		_, err = io.ReadFull(r, itemHeader)
+		if err != nil {
+			return nil, fmt.Errorf("%w: item %d: %v", ErrPayloadCorrupt, i, err)
+		}
+
+		dataLen := int64(binary.BigEndian.Uint32(itemHeader[1:]))
+		if l, ok := r.(lener); ok && dataLen+frameItemTrailerSize > int64(l.Len()) {
+			return nil, fmt.Errorf("%w: item %d claims %d bytes, only %d left in image", ErrPayloadCorrupt, i, dataLen, l.Len())
+		}
+		if dataLen > int64(maxSize) {
+			return nil, fmt.Errorf("%w: item %d is %d bytes, maximum is %d bytes", ErrPayloadTooLarge, i, dataLen, maxSize)
+		}
+
+		data := make([]byte, dataLen+frameItemTrailerSize)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: item %d: %v", ErrPayloadCorrupt, i, err)
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(itemHeader)
+		crc.Write(data[:dataLen])
+		if crc.Sum32() != binary.BigEndian.Uint32(data[dataLen:]) {
+			return nil, fmt.Errorf("%w: checksum mismatch in item %d (%v)", ErrPayloadCorrupt, i, PayloadType(itemHeader[0]))
+		}
+
+		items = append(items, PayloadItem{Type: PayloadType(itemHeader[0]), Data: data[:dataLen]})
+	}
+
+	return items, nil
+}
@@ -72,7 +72,7 @@ func fetchKindiAlbumId(user string) (string, error) {
 
 	if httpResponse.StatusCode >= 300 {
 		rb, _ := ioutil.ReadAll(httpResponse.Body)
-		fmt.Printf("fetchKindiAlbumId failed: response body =  %s\n", rb)
+		fmt.Fprintf(console, "fetchKindiAlbumId failed: response body =  %s\n", rb)
 		return "", fmt.Errorf("fetchKindiAlbumId: got status code %d from http.Get(%s)", httpResponse.StatusCode, url)
 	}
 
@@ -141,7 +141,7 @@ func fetchImageURL(user string) (string, error) {
 
 	if httpResponse.StatusCode >= 300 {
 		rb, _ := ioutil.ReadAll(httpResponse.Body)
-		fmt.Printf("fetchImageURL failed: response body =  %s\n", rb)
+		fmt.Fprintf(console, "fetchImageURL failed: response body =  %s\n", rb)
 		return "", fmt.Errorf("fetchImageURL: got status code %d from http.Get(%s)", httpResponse.StatusCode, url)
 	}
 
@@ -191,11 +191,18 @@ func fetchCertBytes(user string) ([]byte, error) {
 
 	if httpResponse.StatusCode >= 300 {
 		rb, _ := ioutil.ReadAll(httpResponse.Body)
-		fmt.Printf("fetchCertBytes: response body =  %s\n", rb)
+		fmt.Fprintf(console, "fetchCertBytes: response body =  %s\n", rb)
 		return nil, fmt.Errorf("fetchCertBytes: got status code %d from http.Get(%s)", httpResponse.StatusCode, imageURL)
 	}
 
-	return DecodePNG(httpResponse.Body)
+	cert, corrected, err := decodeCertImage(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if corrected > 0 {
+		fmt.Fprintf(console, "fetchCertBytes: repaired %d damaged bytes in certificate image of %s\n", corrected, user)
+	}
+	return cert, nil
 }
 
 func oauthClient() (*http.Client, error) {
@@ -211,13 +218,13 @@ func oauthClient() (*http.Client, error) {
 
 	var transport = &oauth.Transport{Config: oauthConfig}
 
-	fmt.Println("Authentication Procedure (In order to upload your certificate to picasaweb we need to oauth with Google)\n")
+	fmt.Fprintf(console, "Authentication Procedure (In order to upload your certificate to picasaweb we need to oauth with Google)\n\n")
 
 	url := oauthConfig.AuthCodeURL("")
 
-	fmt.Println("\nPlease authenticate with Google by visiting the following URL:\n")
-	fmt.Println(url)
-	fmt.Printf("\nGrant access, and then enter the verification code here: ")
+	fmt.Fprintf(console, "\nPlease authenticate with Google by visiting the following URL:\n\n")
+	fmt.Fprintln(console, url)
+	fmt.Fprintf(console, "\nGrant access, and then enter the verification code here: ")
 
 	verificationCode := ""
 	fmt.Scanln(&verificationCode)
@@ -250,7 +257,7 @@ func uploadCertPNG(path string) error {
 	defer r.Close()
 
 	url := "https://picasaweb.google.com/data/feed/api/user/" + myGmail + "/albumid/" + albumId
-	httpResponse, err := httpClient.Post(url, "image/png", r)
+	httpResponse, err := httpClient.Post(url, "image/"+carrierForPath(path).name(), r)
 	if err != nil {
 		return err
 	}
@@ -259,7 +266,7 @@ func uploadCertPNG(path string) error {
 
 	if httpResponse.StatusCode >= 300 {
 		rb, _ := ioutil.ReadAll(httpResponse.Body)
-		fmt.Printf("uploadCertPNG failed: response body =  %s\n", rb)
+		fmt.Fprintf(console, "uploadCertPNG failed: response body =  %s\n", rb)
 		return fmt.Errorf("uploadCertPNG: got status code %d from http.Post(%s)", httpResponse.StatusCode, url)
 	}
 
@@ -279,7 +286,7 @@ func createKindiAlbum(httpClient *http.Client) (string, error) {
 
 	if httpResponse.StatusCode >= 300 {
 		rb, _ := ioutil.ReadAll(httpResponse.Body)
-		fmt.Printf("createKindiAlbum post failed: response body =  %s\n", rb)
+		fmt.Fprintf(console, "createKindiAlbum post failed: response body =  %s\n", rb)
 		return "", fmt.Errorf("createKindiAlbum: post: got status code %d from http.Post(%s)", httpResponse.StatusCode, url)
 	}
 
@@ -0,0 +1,119 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"runtime"
+	"sync"
+)
+
+// pipeline runs jobs concurrently and hands their results to a sink in the
+// order the jobs were submitted. At most 2*workers jobs are in flight, so
+// submit blocks while the sink falls behind.
+type pipeline struct {
+	queue chan chan pipelineResult
+	done  chan error
+
+	mu  sync.Mutex
+	err error
+}
+
+type pipelineResult struct {
+	data []byte
+	err  error
+}
+
+// chunkWorkers returns how many chunks are encrypted or decrypted at once.
+func chunkWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+func newPipeline(workers int, sink func(data []byte) error) *pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+
+	rv := new(pipeline)
+	rv.queue = make(chan chan pipelineResult, 2*workers)
+	rv.done = make(chan error, 1)
+
+	go func() {
+		var err error
+		for res := range rv.queue {
+			r := <-res
+			if err != nil {
+				continue
+			}
+
+			err = r.err
+			if err == nil {
+				err = sink(r.data)
+			}
+			if err != nil {
+				rv.mu.Lock()
+				rv.err = err
+				rv.mu.Unlock()
+			}
+		}
+		rv.done <- err
+	}()
+
+	return rv
+}
+
+// failed returns the first error of a job or the sink so far.
+func (p *pipeline) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// submit queues job, returning early with the first error seen so far.
+func (p *pipeline) submit(job func() ([]byte, error)) error {
+	err := p.failed()
+	if err != nil {
+		return err
+	}
+
+	res := make(chan pipelineResult, 1)
+	p.queue <- res
+
+	go func() {
+		data, err := job()
+		res <- pipelineResult{data: data, err: err}
+	}()
+	return nil
+}
+
+// wait waits for all submitted jobs and returns the first error. The
+// pipeline can't be used afterwards.
+func (p *pipeline) wait() error {
+	close(p.queue)
+	return <-p.done
+}
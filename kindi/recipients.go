@@ -0,0 +1,133 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Version 4 files can be opened by more than one key, by default the
+// recipient's and the sender's own. Their header starts with the list of
+// recipients where version 2 has the single wrapped key, each one
+//
+//	lengthEncoded(fingerprint), lengthEncoded(wrapped key)
+//
+// with the fingerprint the SHA-256 of the PKIX public key, as KeyFingerprint
+// shows it. Fingerprints are in the clear, so a key finds its wrapped key
+// without trying them all and Inspect can tell who is able to decrypt.
+const (
+	maxRecipients     = 64
+	maxRecipientsSize = maxRecipients * (16 + sha256.Size + maxWrappedKeySize)
+)
+
+type recipient struct {
+	fingerprint []byte
+	wrappedKey  []byte
+}
+
+// wrapKey wraps symmetricKey for each of keys, skipping keys that appear
+// more than once.
+func wrapKey(symmetricKey []byte, keys []*rsa.PublicKey) ([]recipient, error) {
+	if len(keys) == 0 || len(keys) > maxRecipients {
+		return nil, fmt.Errorf("%d recipients, want 1 to %d", len(keys), maxRecipients)
+	}
+
+	recipients := make([]recipient, 0, len(keys))
+	for _, key := range keys {
+		fp := keyFingerprint(key)
+		if fp == nil {
+			return nil, errors.New("can't fingerprint recipient key")
+		}
+		if _, err := findRecipient(recipients, fp); err == nil {
+			continue
+		}
+
+		wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, symmetricKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient{fingerprint: fp, wrappedKey: wrapped})
+	}
+	return recipients, nil
+}
+
+func encodeRecipients(recipients []recipient) []byte {
+	buf := new(bytes.Buffer)
+	for _, r := range recipients {
+		writeLengthEncoded(buf, r.fingerprint)
+		writeLengthEncoded(buf, r.wrappedKey)
+	}
+	return buf.Bytes()
+}
+
+func decodeRecipients(data []byte) ([]recipient, error) {
+	buf := bytes.NewBuffer(data)
+
+	var recipients []recipient
+	for buf.Len() > 0 {
+		if len(recipients) == maxRecipients {
+			return nil, &FormatError{Field: "recipients", Err: fmt.Errorf("more than %d", maxRecipients)}
+		}
+
+		fp, err := readLengthEncoded(buf, "recipient fingerprint", sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		if len(fp) != sha256.Size {
+			return nil, &FormatError{Field: "recipient fingerprint", Err: fmt.Errorf("%d bytes, want %d", len(fp), sha256.Size)}
+		}
+
+		wrapped, err := readLengthEncoded(buf, "wrapped key", maxWrappedKeySize)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient{fingerprint: fp, wrappedKey: wrapped})
+	}
+
+	if len(recipients) == 0 {
+		return nil, &FormatError{Field: "recipients", Err: errors.New("none")}
+	}
+	return recipients, nil
+}
+
+// findRecipient returns the key wrapped for the key with fingerprint fp.
+func findRecipient(recipients []recipient, fp []byte) ([]byte, error) {
+	for _, r := range recipients {
+		if bytes.Equal(r.fingerprint, fp) {
+			return r.wrappedKey, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: key %x is not among the %d recipients", ErrNotRecipient, fp, len(recipients))
+}
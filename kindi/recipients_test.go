@@ -0,0 +1,261 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMultipleRecipients(t *testing.T) {
+	payload := []byte("for both of us")
+
+	envelope, sender, recipient := newTestEnvelope(t)
+	self, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+	envelope.recipientKeys = append(envelope.recipientKeys, &self.PublicKey, &recipient.PublicKey)
+
+	buf := new(bytes.Buffer)
+	err = envelope.encrypt(buf, bytes.NewReader(payload), []byte("both.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	encrypted := buf.Bytes()
+
+	for _, key := range []*rsa.PrivateKey{recipient, self} {
+		out := new(bytes.Buffer)
+		err = decrypt(out, bytes.NewReader(encrypted), key, keychainFor(sender))
+		if err != nil {
+			t.Fatalf("failed to decrypt %v", err)
+		}
+		if !bytes.Equal(out.Bytes(), payload) {
+			t.Fatalf("decrypted payload different from original payload")
+		}
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+	err = decrypt(ioutil.Discard, bytes.NewReader(encrypted), other, keychainFor(sender))
+	if !errors.Is(err, ErrNotRecipient) {
+		t.Fatalf("expected ErrNotRecipient, got %v", err)
+	}
+
+	info, err := inspect(bytes.NewReader(encrypted), int64(len(encrypted)), "both.txt.kindi")
+	if err != nil {
+		t.Fatalf("failed to inspect %v", err)
+	}
+	want := []string{KeyFingerprint(&recipient.PublicKey), KeyFingerprint(&self.PublicKey)}
+	if len(info.Recipients) != len(want) || info.Recipients[0] != want[0] || info.Recipients[1] != want[1] {
+		t.Fatalf("expected recipients %v without duplicates, got %v", want, info.Recipients)
+	}
+}
+
+// encryptVersion2 writes payload as a version 2 .kindi file, chunked like
+// version 4 but with a single wrapped key, as kindi did before multiple
+// recipients.
+func encryptVersion2(t *testing.T, payload []byte, chunkSize int) ([]byte, keychainFunc, *rsa.PrivateKey) {
+	envelope, sender, recipient := newTestEnvelope(t)
+	params := &bodyParams{chunkSize: chunkSize}
+
+	symmetricKey := make([]byte, 32)
+	rand.Read(symmetricKey)
+
+	header, headerHash, err := envelope.newHeader(formatVersion2, symmetricKey, []byte("disk.img"), params, nil)
+	if err != nil {
+		t.Fatalf("failed new header %v", err)
+	}
+
+	out := bytes.NewBuffer(append(fileMagic[:len(fileMagic):len(fileMagic)], formatVersion2))
+	writeLengthEncoded(out, header)
+	writeLengthEncoded(out, headerHash)
+
+	cw, err := newChunkWriter(out, symmetricKey, headerHash, params, chunkWorkers())
+	if err != nil {
+		t.Fatalf("failed to create chunk writer %v", err)
+	}
+	cw.Write(payload)
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	return out.Bytes(), keychainFor(sender), recipient
+}
+
+func TestDecryptVersion2(t *testing.T) {
+	payload := make([]byte, 300)
+	rand.Read(payload)
+
+	encrypted, keychain, recipient := encryptVersion2(t, payload, 64)
+
+	out := new(bytes.Buffer)
+	err := decrypt(out, bytes.NewReader(encrypted), recipient, keychain)
+	if err != nil {
+		t.Fatalf("failed to decrypt %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatalf("decrypted payload different from original payload")
+	}
+
+	data, err := ioutil.ReadAll(mustOpenReader(t, encrypted, recipient, keychain))
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("failed to read version 2 file at random %v", err)
+	}
+}
+
+// rewriteRecipients replaces the recipients of the version 4 file encrypted
+// with the key block rewrite returns and writes it as a version version
+// file, keeping the rest of the header, the header hmac and the body.
+func rewriteRecipients(t *testing.T, encrypted []byte, version byte, rewrite func([]recipient) []byte) []byte {
+	r := bytes.NewReader(encrypted[len(fileMagic)+1:])
+	header, headerHash, err := readHeaderAndHash(r)
+	if err != nil {
+		t.Fatalf("failed to read header %v", err)
+	}
+
+	buf := bytes.NewBuffer(header)
+	encoded, err := readLengthEncoded(buf, "recipients", maxRecipientsSize)
+	if err != nil {
+		t.Fatalf("failed to read recipients %v", err)
+	}
+	recipients, err := decodeRecipients(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode recipients %v", err)
+	}
+
+	rewritten := new(bytes.Buffer)
+	writeLengthEncoded(rewritten, rewrite(recipients))
+	rewritten.Write(buf.Bytes())
+
+	out := bytes.NewBuffer(append(fileMagic[:len(fileMagic):len(fileMagic)], version))
+	writeLengthEncoded(out, rewritten.Bytes())
+	writeLengthEncoded(out, headerHash)
+	r.WriteTo(out)
+	return out.Bytes()
+}
+
+func TestRecipientsAuthenticated(t *testing.T) {
+	envelope, sender, key := newTestEnvelope(t)
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+	envelope.recipientKeys = append(envelope.recipientKeys, &other.PublicKey)
+
+	buf := new(bytes.Buffer)
+	err = envelope.encrypt(buf, bytes.NewReader([]byte("for both of us")), []byte("both.txt"))
+	if err != nil {
+		t.Fatalf("failed to encrypt %v", err)
+	}
+	encrypted := buf.Bytes()
+
+	tampered := map[string][]byte{
+		"downgraded to version 2": rewriteRecipients(t, encrypted, formatVersion2, func(rs []recipient) []byte {
+			return rs[0].wrappedKey
+		}),
+		"other recipient stripped": rewriteRecipients(t, encrypted, formatVersion4, func(rs []recipient) []byte {
+			return encodeRecipients(rs[:1])
+		}),
+		"recipients reordered": rewriteRecipients(t, encrypted, formatVersion4, func(rs []recipient) []byte {
+			rs[0], rs[1] = rs[1], rs[0]
+			return encodeRecipients(rs)
+		}),
+	}
+	for name, data := range tampered {
+		err = decrypt(ioutil.Discard, bytes.NewReader(data), key, keychainFor(sender))
+		if !errors.Is(err, ErrMACMismatch) {
+			t.Fatalf("%s: expected ErrMACMismatch, got %v", name, err)
+		}
+	}
+
+	untouched := rewriteRecipients(t, encrypted, formatVersion4, encodeRecipients)
+	err = decrypt(ioutil.Discard, bytes.NewReader(untouched), key, keychainFor(sender))
+	if err != nil {
+		t.Fatalf("failed to decrypt the unchanged file %v", err)
+	}
+}
+
+func TestDecodeRecipients(t *testing.T) {
+	stanza := func(fp []byte) []byte {
+		buf := new(bytes.Buffer)
+		writeLengthEncoded(buf, fp)
+		writeLengthEncoded(buf, make([]byte, 128))
+		return buf.Bytes()
+	}
+
+	many := new(bytes.Buffer)
+	for i := 0; i <= maxRecipients; i++ {
+		many.Write(stanza(make([]byte, 32)))
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":             nil,
+		"short fingerprint": stanza(make([]byte, 20)),
+		"too many":          many.Bytes(),
+		"truncated":         stanza(make([]byte, 32))[:100],
+	} {
+		_, err := decodeRecipients(data)
+		if !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%s: expected ErrMalformed, got %v", name, err)
+		}
+	}
+}
+
+func TestRecipientEnvelope(t *testing.T) {
+	_, _, recipient := newTestEnvelope(t)
+	self, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+
+	savedKey, savedGmail := myPrivateKey, myGmail
+	defer func() { myPrivateKey, myGmail = savedKey, savedGmail }()
+	myPrivateKey, myGmail = self, "me@gmail.com"
+
+	envelope, result := recipientEnvelope([]byte("you@gmail.com"), &recipient.PublicKey, false)
+	if len(envelope.recipientKeys) != 2 || envelope.recipientKeys[1] != &self.PublicKey {
+		t.Fatalf("expected the key wrapped for the sender too, got %d keys", len(envelope.recipientKeys))
+	}
+	want := []string{KeyFingerprint(&recipient.PublicKey), KeyFingerprint(&self.PublicKey)}
+	if len(result.Recipients) != 2 || result.Recipients[1] != "me@gmail.com" || len(result.RecipientFingerprints) != 2 || result.RecipientFingerprints[1] != want[1] {
+		t.Fatalf("expected recipients you and me %v, got %v %v", want, result.Recipients, result.RecipientFingerprints)
+	}
+
+	envelope, result = recipientEnvelope([]byte("you@gmail.com"), &recipient.PublicKey, true)
+	if len(envelope.recipientKeys) != 1 || len(result.Recipients) != 1 || result.RecipientFingerprints[0] != want[0] {
+		t.Fatalf("expected only the recipient with noSelf, got %v", result.RecipientFingerprints)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"errors"
+)
+
+// Reed-Solomon codes over GF(2^8) (primitive polynomial x^8+x^4+x^3+x^2+1,
+// generator roots alpha^0 to alpha^(parity-1)) protect embedded frames
+// against bits flipped by image hosts. A codeword is at most 255 bytes, data
+// followed by parity bytes, and can repair up to parity/2 damaged bytes.
+// Shorter codewords are shortened codes, as if padded with leading zeros.
+const rsCodewordSize = 255
+
+var errTooManyErrors = errors.New("too many errors to correct")
+
+var (
+	gfExp [2 * rsCodewordSize]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < rsCodewordSize; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := rsCodewordSize; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-rsCodewordSize]
+	}
+}
+
+func gfMul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+gfLog[y]]
+}
+
+func gfDiv(x, y byte) byte {
+	if x == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+rsCodewordSize-gfLog[y]]
+}
+
+// gfPowAlpha returns alpha^e for any integer e.
+func gfPowAlpha(e int) byte {
+	e %= rsCodewordSize
+	if e < 0 {
+		e += rsCodewordSize
+	}
+	return gfExp[e]
+}
+
+// Polynomials below are coefficient slices with the lowest power first,
+// except that codewords are read as polynomials with their first byte as the
+// highest power.
+
+// polyEval evaluates p at x.
+func polyEval(p []byte, x byte) byte {
+	var rv byte
+	for i := len(p) - 1; i >= 0; i-- {
+		rv = gfMul(rv, x) ^ p[i]
+	}
+	return rv
+}
+
+// rsGenerator returns the product of (x - alpha^i) for i below parity.
+func rsGenerator(parity int) []byte {
+	g := []byte{1}
+	for i := 0; i < parity; i++ {
+		next := make([]byte, len(g)+1)
+		root := gfExp[i]
+		for j, c := range g {
+			next[j] ^= gfMul(c, root)
+			next[j+1] ^= c
+		}
+		g = next
+	}
+	return g
+}
+
+// rsEncode returns data followed by parity bytes. len(data)+parity must not
+// exceed rsCodewordSize.
+func rsEncode(data []byte, parity int) []byte {
+	g := rsGenerator(parity)
+
+	// remainder of data * x^parity divided by g, computed by long division
+	rem := make([]byte, parity)
+	for _, b := range data {
+		coef := b ^ rem[parity-1]
+		copy(rem[1:], rem[:parity-1])
+		rem[0] = 0
+		if coef != 0 {
+			for j := 0; j < parity; j++ {
+				rem[j] ^= gfMul(g[j], coef)
+			}
+		}
+	}
+
+	rv := make([]byte, 0, len(data)+parity)
+	rv = append(rv, data...)
+	for j := parity - 1; j >= 0; j-- {
+		rv = append(rv, rem[j])
+	}
+	return rv
+}
+
+// rsSyndromes returns the codeword evaluated at the generator roots, all
+// zero if the codeword is undamaged.
+func rsSyndromes(codeword []byte, parity int) ([]byte, bool) {
+	synd := make([]byte, parity)
+	clean := true
+	for i := range synd {
+		root := gfExp[i]
+		var s byte
+		for _, b := range codeword {
+			s = gfMul(s, root) ^ b
+		}
+		synd[i] = s
+		if s != 0 {
+			clean = false
+		}
+	}
+	return synd, clean
+}
+
+// rsDecode repairs codeword in place and returns the number of bytes it
+// repaired. It fails with errTooManyErrors if codeword has more damaged bytes
+// than it can repair, as far as it can tell.
+func rsDecode(codeword []byte, parity int) (int, error) {
+	synd, clean := rsSyndromes(codeword, parity)
+	if clean {
+		return 0, nil
+	}
+
+	// Berlekamp-Massey: the error locator lambda has a root at
+	// alpha^-p for every damaged power p
+	lambda := []byte{1}
+	prev := []byte{1}
+	l := 0
+	m := 1
+	b := byte(1)
+	for n := 0; n < parity; n++ {
+		d := synd[n]
+		for i := 1; i <= l && i < len(lambda); i++ {
+			d ^= gfMul(lambda[i], synd[n-i])
+		}
+		if d == 0 {
+			m++
+			continue
+		}
+
+		size := len(prev) + m
+		if size < len(lambda) {
+			size = len(lambda)
+		}
+		next := make([]byte, size)
+		copy(next, lambda)
+		scale := gfDiv(d, b)
+		for i, c := range prev {
+			next[i+m] ^= gfMul(c, scale)
+		}
+
+		if 2*l <= n {
+			prev = lambda
+			l = n + 1 - l
+			b = d
+			m = 1
+		} else {
+			m++
+		}
+		lambda = next
+	}
+
+	if 2*l > parity {
+		return 0, errTooManyErrors
+	}
+	lambda = lambda[:l+1]
+
+	// Chien search over the powers present in the (shortened) codeword
+	n := len(codeword)
+	var powers []int
+	for p := 0; p < n; p++ {
+		if polyEval(lambda, gfPowAlpha(-p)) == 0 {
+			powers = append(powers, p)
+		}
+	}
+	if len(powers) != l {
+		return 0, errTooManyErrors
+	}
+
+	// Forney: omega = synd * lambda mod x^parity, the error at power p is
+	// X * omega(1/X) / lambda'(1/X) with X = alpha^p
+	omega := make([]byte, parity)
+	for i, s := range synd {
+		for j := 0; j < len(lambda) && i+j < parity; j++ {
+			omega[i+j] ^= gfMul(s, lambda[j])
+		}
+	}
+	derivative := make([]byte, len(lambda))
+	for i := 1; i < len(lambda); i += 2 {
+		derivative[i-1] = lambda[i]
+	}
+
+	for _, p := range powers {
+		x := gfPowAlpha(p)
+		xinv := gfPowAlpha(-p)
+		denom := polyEval(derivative, xinv)
+		if denom == 0 {
+			return 0, errTooManyErrors
+		}
+		codeword[n-1-p] ^= gfMul(x, gfDiv(polyEval(omega, xinv), denom))
+	}
+
+	if _, clean = rsSyndromes(codeword, parity); !clean {
+		return 0, errTooManyErrors
+	}
+	return len(powers), nil
+}
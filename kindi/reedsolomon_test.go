@@ -0,0 +1,103 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"bytes"
+	"errors"
+	mrand "math/rand"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rnd := mrand.New(mrand.NewSource(1))
+
+	for _, parity := range []int{8, 16, 56} {
+		for _, size := range []int{1, 4, 100, rsCodewordSize - parity} {
+			data := make([]byte, size)
+			rnd.Read(data)
+
+			codeword := rsEncode(data, parity)
+			if len(codeword) != size+parity {
+				t.Fatalf("expected codeword of %d bytes, got %d", size+parity, len(codeword))
+			}
+
+			corrected, err := rsDecode(codeword, parity)
+			if err != nil || corrected != 0 {
+				t.Fatalf("clean codeword: %d corrections, %v", corrected, err)
+			}
+
+			for damage := 1; damage <= parity/2; damage++ {
+				damaged := append([]byte(nil), codeword...)
+				for _, i := range rnd.Perm(len(damaged))[:damage] {
+					damaged[i] ^= byte(1 + rnd.Intn(255))
+				}
+
+				corrected, err = rsDecode(damaged, parity)
+				if err != nil {
+					t.Fatalf("parity %d, size %d, %d damaged bytes: %v", parity, size, damage, err)
+				}
+				if corrected != damage {
+					t.Fatalf("expected %d corrections, got %d", damage, corrected)
+				}
+				if !bytes.Equal(damaged, codeword) {
+					t.Fatalf("parity %d, size %d, %d damaged bytes: not repaired", parity, size, damage)
+				}
+			}
+		}
+	}
+}
+
+func TestReedSolomonTooManyErrors(t *testing.T) {
+	rnd := mrand.New(mrand.NewSource(2))
+
+	data := make([]byte, 200)
+	rnd.Read(data)
+	codeword := rsEncode(data, 16)
+
+	// beyond the limit decoding must fail or, rarely, produce a different
+	// valid codeword, but never claim success with the damage still there
+	for trial := 0; trial < 100; trial++ {
+		damaged := append([]byte(nil), codeword...)
+		for _, i := range rnd.Perm(len(damaged))[:9+rnd.Intn(20)] {
+			damaged[i] ^= byte(1 + rnd.Intn(255))
+		}
+
+		_, err := rsDecode(damaged, 16)
+		if err == nil {
+			if _, clean := rsSyndromes(damaged, 16); !clean {
+				t.Fatalf("decoding succeeded on an invalid codeword")
+			}
+			continue
+		}
+		if !errors.Is(err, errTooManyErrors) {
+			t.Fatalf("expected errTooManyErrors, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2011 Uwe Hoffmann. All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * The name Uwe Hoffmann may not be used to endorse or promote
+// products derived from this software without specific prior written
+// permission.
+
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package kindi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// golang.org/x/image/webp only decodes, so kindi carries the smallest
+// lossless (VP8L) WebP encoder that works: no transforms, no color cache, no
+// backward references and prefix codes that give every byte value 8 bits.
+// The result is about as big as an uncompressed bitmap, but lossless, which
+// is all a carrier needs.
+
+const (
+	vp8lSignature    = 0x2f
+	vp8lMaxDimension = 1 << 14
+
+	// symbols of the green code beyond the 256 literals are length prefixes
+	vp8lGreenAlphabet = 256 + 24
+)
+
+// vp8lCodeLengthOrder is the order code length code lengths are written in.
+var vp8lCodeLengthOrder = []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lBitWriter packs values lowest bit first, as VP8L wants them.
+type vp8lBitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (bw *vp8lBitWriter) write(v uint32, bits uint) {
+	bw.acc |= uint64(v) << bw.nacc
+	bw.nacc += bits
+	for bw.nacc >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nacc -= 8
+	}
+}
+
+func (bw *vp8lBitWriter) flush() []byte {
+	if bw.nacc > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc = 0
+		bw.nacc = 0
+	}
+	return bw.buf
+}
+
+// writeFlatCode writes a prefix code giving the first 256 symbols of an
+// alphabet of alphabetSize symbols 8 bits each and the rest none. The code
+// lengths themselves are coded with 1 bit, 1 for 8 and 0 for 0.
+func (bw *vp8lBitWriter) writeFlatCode(alphabetSize int) {
+	bw.write(0, 1) // normal, not simple, code
+
+	n := 0
+	for i, l := range vp8lCodeLengthOrder {
+		if l == 8 {
+			n = i + 1
+		}
+	}
+	bw.write(uint32(n-4), 4)
+	for _, l := range vp8lCodeLengthOrder[:n] {
+		if l == 0 || l == 8 {
+			bw.write(1, 3)
+		} else {
+			bw.write(0, 3)
+		}
+	}
+
+	bw.write(0, 1) // code lengths for the whole alphabet follow
+	for i := 0; i < alphabetSize; i++ {
+		if i < 256 {
+			bw.write(1, 1)
+		} else {
+			bw.write(0, 1)
+		}
+	}
+}
+
+// writeLiteral writes v with a code writeFlatCode wrote. Prefix codes are
+// written starting with their highest bit.
+func (bw *vp8lBitWriter) writeLiteral(v byte) {
+	var r uint32
+	for i := uint(0); i < 8; i++ {
+		r |= uint32(v>>i&1) << (7 - i)
+	}
+	bw.write(r, 8)
+}
+
+// encodeWebPLossless writes m to w as lossless WebP.
+func encodeWebPLossless(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > vp8lMaxDimension || b.Dy() > vp8lMaxDimension {
+		return fmt.Errorf("WebP can't hold a %dx%d image", b.Dx(), b.Dy())
+	}
+
+	nrgba, ok := m.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		draw.Draw(nrgba, b, m, b.Min, draw.Src)
+	}
+
+	bw := new(vp8lBitWriter)
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(b.Dx()-1), 14)
+	bw.write(uint32(b.Dy()-1), 14)
+	if nrgba.Opaque() {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3) // version
+
+	bw.write(0, 1) // no transforms
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // a single prefix code group
+
+	// green, red, blue and alpha codes
+	bw.writeFlatCode(vp8lGreenAlphabet)
+	bw.writeFlatCode(256)
+	bw.writeFlatCode(256)
+	bw.writeFlatCode(256)
+
+	// the distance code is never used, a simple code with symbol 0
+	bw.write(1, 1)
+	bw.write(0, 1)
+	bw.write(0, 1)
+	bw.write(0, 1)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		pix := nrgba.Pix[nrgba.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			p := pix[4*x : 4*x+4]
+			bw.writeLiteral(p[1])
+			bw.writeLiteral(p[0])
+			bw.writeLiteral(p[2])
+			bw.writeLiteral(p[3])
+		}
+	}
+
+	data := bw.flush()
+	pad := len(data) & 1
+
+	header := make([]byte, 20)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+len(data)+pad))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	if pad != 0 {
+		_, err = w.Write([]byte{0})
+	}
+	return err
+}
@@ -30,19 +30,521 @@ package main
 
 import (
 	"./kindi"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
 )
 
 const baseUrl = "https://uwe-oauth.appspot.com"
-const versionStr = "1.4"
+const versionStr = "1.5"
+
+// Exit codes are part of the command line interface, scripts depend on them
+// staying stable.
+const (
+	exitOK               = 0
+	exitFailure          = 1
+	exitUsage            = 2
+	exitKeychain         = 3
+	exitUnknownRecipient = 4
+	exitUnknownSender    = 5
+	exitNotRecipient     = 6
+	exitMACMismatch      = 7
+	exitSignature        = 8
+	exitInputRequired    = 9
+	exitCarrierTooSmall  = 10
+	exitNoPayload        = 11
+	exitMalformed        = 12
+	exitPassphrase       = 13
+)
+
+var errorCodes = map[int]string{
+	exitFailure:          "failure",
+	exitUsage:            "usage",
+	exitKeychain:         "keychain",
+	exitUnknownRecipient: "unknown_recipient",
+	exitUnknownSender:    "unknown_sender",
+	exitNotRecipient:     "not_recipient",
+	exitMACMismatch:      "mac_mismatch",
+	exitSignature:        "signature",
+	exitInputRequired:    "input_required",
+	exitCarrierTooSmall:  "carrier_too_small",
+	exitNoPayload:        "no_payload",
+	exitMalformed:        "malformed",
+	exitPassphrase:       "passphrase",
+}
+
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, kindi.ErrUnknownRecipient):
+		return exitUnknownRecipient
+	case errors.Is(err, kindi.ErrUnknownSender):
+		return exitUnknownSender
+	case errors.Is(err, kindi.ErrNotRecipient):
+		return exitNotRecipient
+	case errors.Is(err, kindi.ErrMACMismatch):
+		return exitMACMismatch
+	case errors.Is(err, kindi.ErrSignature):
+		return exitSignature
+	case errors.Is(err, kindi.ErrInputRequired):
+		return exitInputRequired
+	case errors.Is(err, kindi.ErrImageTooSmall):
+		return exitCarrierTooSmall
+	case errors.Is(err, kindi.ErrNoPayload):
+		return exitNoPayload
+	case errors.Is(err, kindi.ErrMalformed):
+		return exitMalformed
+	case errors.Is(err, kindi.ErrPassphrase):
+		return exitPassphrase
+	}
+	return exitFailure
+}
+
+func keychainExitCode(err error) int {
+	code := exitCode(err)
+	if code == exitFailure {
+		code = exitKeychain
+	}
+	return code
+}
+
+// report is what --json prints on stdout, exactly one per invocation.
+type report struct {
+	Operation             string          `json:"operation"`
+	Email                 string          `json:"email,omitempty"`
+	Fingerprint           string          `json:"fingerprint,omitempty"`
+	Input                 string          `json:"input,omitempty"`
+	Output                string          `json:"output,omitempty"`
+	Carrier               string          `json:"carrier,omitempty"`
+	Compression           string          `json:"compression,omitempty"`
+	Metadata              kindi.Metadata  `json:"metadata,omitempty"`
+	Sender                string          `json:"sender,omitempty"`
+	SenderFingerprint     string          `json:"sender_fingerprint,omitempty"`
+	Recipients            []string        `json:"recipients,omitempty"`
+	RecipientFingerprints []string        `json:"recipient_fingerprints,omitempty"`
+	Inspect               *kindi.FileInfo `json:"inspect,omitempty"`
+	Version               string          `json:"version,omitempty"`
+	Error                 string          `json:"error,omitempty"`
+	ErrorCode             string          `json:"error_code,omitempty"`
+	ExitCode              int             `json:"exit_code"`
+}
+
+var jsonOutput bool
+
+func (rep *report) setResult(res *kindi.Result) {
+	rep.Output = res.Output
+	rep.Carrier = res.Carrier
+	rep.Compression = res.Compression
+	rep.Metadata = res.Metadata
+	rep.Sender = res.Sender
+	rep.SenderFingerprint = res.SenderFingerprint
+	rep.Recipients = res.Recipients
+	rep.RecipientFingerprints = res.RecipientFingerprints
+}
+
+// parseFlags parses the flags of a subcommand. Bad flags fail like any other
+// usage error, so --json still reports them on stdout.
+func parseFlags(rep *report, fs *flag.FlagSet, args []string) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		fail(rep, exitUsage, err)
+	}
+}
+
+func succeed(rep *report) {
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	os.Exit(exitOK)
+}
+
+func fail(rep *report, code int, err error) {
+	rep.Error = err.Error()
+	rep.ErrorCode = errorCodes[code]
+	rep.ExitCode = code
+
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(rep)
+	} else {
+		if code == exitUnknownRecipient {
+			fmt.Fprintf(os.Stderr, "Recipient has not used Kindi yet. Please ask recipient to install Kindi and run it at least once, or use kindi encrypt --passphrase.\n")
+		}
+		what := rep.Operation
+		if len(rep.Input) > 0 {
+			what += " " + rep.Input
+		}
+		log.Printf("Error: %s: %v", what, err)
+	}
+	os.Exit(code)
+}
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "%s version %s:\n", os.Args[0], versionStr)
-	fmt.Fprintf(os.Stderr, "\t%s [--help] [--version] [--to <gmail address>] <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t%s [--help] [--version] [--json] [--to <gmail address> [--armor] [--no-self] [--compress <method>] [--pad <scheme>] [--note <text>] [--expires <duration>] [--name <naming>]] <file>\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\tif --to flag is present, then kindi encrypts, otherwise it decrypts\n")
+	fmt.Fprintf(os.Stderr, "\t--armor writes a text (base64) file instead of binary, decrypting detects either\n")
+	fmt.Fprintf(os.Stderr, "\tyour own key can decrypt what you encrypt as well, unless you add --no-self\n")
+	fmt.Fprintf(os.Stderr, "\t--compress compresses before encrypting unless the file looks compressed already, methods are %s\n", strings.Join(kindi.CompressionMethods(), ", "))
+	fmt.Fprintf(os.Stderr, "\t--name random or --name hash gives the encrypted file a name that doesn't reveal the original one, decrypting restores it\n")
+	fmt.Fprintf(os.Stderr, "\t--note and --expires (like 720h) travel in the encrypted header, decrypting restores the file's mode and modification time\n")
+	fmt.Fprintf(os.Stderr, "\t--pad pads the file so its encrypted size only reveals a size class, schemes are %s\n", strings.Join(kindi.PaddingSchemes(), ", "))
+	fmt.Fprintf(os.Stderr, "\t%s [--json] encrypt --passphrase [--armor] [--compress <method>] [--pad <scheme>] [--note <text>] [--expires <duration>] [--name <naming>] <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tencrypts with a passphrase (asked for, or KINDI_PASSPHRASE) instead of for a recipient, decrypting asks for it\n")
+	fmt.Fprintf(os.Stderr, "\t%s [--json] inspect <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tshows what is known about an encrypted file without decrypting it\n")
+	fmt.Fprintf(os.Stderr, "\t%s [--json] hide --to <gmail address> --carrier <image> [--out <image>] [--format <format>] [--key <key>] [--no-self] <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tencrypts file and hides it in a copy of the carrier image, formats are %s\n", strings.Join(kindi.CarrierFormats(), ", "))
+	fmt.Fprintf(os.Stderr, "\t%s [--json] reveal [--key <key>] <image>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\textracts and decrypts a file hidden in an image, --key must match the one used to hide it\n")
+	fmt.Fprintf(os.Stderr, "\t%s [--json] init [--email <gmail address>] [--image <path>] [--no-publish]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tsets up your key without ever prompting, defaults come from KINDI_EMAIL, KINDI_IMAGE and KINDI_NO_PUBLISH\n")
+	fmt.Fprintf(os.Stderr, "\t%s publish\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\tuploads your certificate to picasaweb (asks you to authenticate with Google)\n")
+	fmt.Fprintf(os.Stderr, "\tsetting KINDI_NONINTERACTIVE=1 makes every command fail instead of prompting\n")
+	fmt.Fprintf(os.Stderr, "\t--json prints one JSON result object on stdout, exit codes tell failures apart:\n")
+	for code := exitFailure; code <= exitPassphrase; code++ {
+		fmt.Fprintf(os.Stderr, "\t\t%d %s\n", code, errorCodes[code])
+	}
+}
+
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(name))
+	return b
+}
+
+func initOptionsFromEnv() *kindi.InitOptions {
+	return &kindi.InitOptions{
+		Email:          os.Getenv("KINDI_EMAIL"),
+		ImagePath:      os.Getenv("KINDI_IMAGE"),
+		NoPublish:      envBool("KINDI_NO_PUBLISH"),
+		NonInteractive: envBool("KINDI_NONINTERACTIVE"),
+	}
+}
+
+// readPassphrase returns KINDI_PASSPHRASE if set and asks for the passphrase
+// otherwise, twice if confirm is set.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if p := os.Getenv("KINDI_PASSPHRASE"); len(p) > 0 {
+		return []byte(p), nil
+	}
+	if envBool("KINDI_NONINTERACTIVE") {
+		return nil, fmt.Errorf("no passphrase given: %w", kindi.ErrInputRequired)
+	}
+
+	// read without echo from a terminal, line by line from a pipe
+	fd := int(os.Stdin.Fd())
+	in := bufio.NewReader(os.Stdin)
+	ask := func(prompt string) ([]byte, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		if term.IsTerminal(fd) {
+			passphrase, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, fmt.Errorf("reading passphrase: %w", err)
+			}
+			return passphrase, nil
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("reading passphrase: %w", err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+
+	passphrase, err := ask("Please enter the passphrase: ")
+	if err != nil || !confirm {
+		return passphrase, err
+	}
+
+	again, err := ask("Please enter the passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func encryptOptions(armor, noSelf bool, compress, pad, note, naming string, expires time.Duration) *kindi.EncryptOptions {
+	opts := &kindi.EncryptOptions{Armor: armor, NoSelf: noSelf, Compression: compress, Padding: pad, Note: note, OutputName: naming}
+	if expires > 0 {
+		opts.Expires = time.Now().Add(expires)
+	}
+	return opts
+}
+
+func encrypt(configDir string, args []string) {
+	rep := &report{Operation: "encrypt"}
+
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	to := fs.String("to", "", "recipient gmail address")
+	passphrase := fs.Bool("passphrase", false, "encrypt with a passphrase instead, decrypting needs no kindi key")
+	armor := fs.Bool("armor", false, "write encrypted output as ASCII armored text")
+	noSelf := fs.Bool("no-self", false, "don't let your own key decrypt the file too")
+	compress := fs.String("compress", "", "compress before encrypting (gzip or flate)")
+	pad := fs.String("pad", "", "pad before encrypting (padme or pow2)")
+	note := fs.String("note", "", "note for the recipient, encrypted with the file")
+	naming := fs.String("name", "", "name the encrypted file plain (foo.txt.kindi), random or hash (of its content)")
+	expires := fs.Duration("expires", 0, "tell the recipient the file is stale after this long")
+	parseFlags(rep, fs, args)
+
+	if fs.NArg() != 1 || (len(*to) > 0) == *passphrase {
+		fail(rep, exitUsage, fmt.Errorf("encrypt needs either --to or --passphrase and exactly one file argument"))
+	}
+	rep.Input = fs.Arg(0)
+
+	opts := encryptOptions(*armor, *noSelf, *compress, *pad, *note, *naming, *expires)
+
+	var res *kindi.Result
+	if *passphrase {
+		p, err := readPassphrase(true)
+		if err != nil {
+			fail(rep, exitCode(err), err)
+		}
+
+		res, err = kindi.EncryptFileWithPassphrase(p, rep.Input, opts)
+		if err != nil {
+			fail(rep, exitCode(err), err)
+		}
+	} else {
+		err := kindi.InitKeychain(configDir, initOptionsFromEnv())
+		if err != nil {
+			fail(rep, keychainExitCode(err), fmt.Errorf("Initializing keychain: %w", err))
+		}
+
+		res, err = kindi.EncryptFile([]byte(*to), rep.Input, opts)
+		if err != nil {
+			fail(rep, exitCode(err), err)
+		}
+	}
+	rep.setResult(res)
+
+	if !jsonOutput {
+		fmt.Printf("finished encrypting file %s into %s\n", rep.Input, res.Output)
+	}
+	succeed(rep)
+}
+
+// decryptWithPassphrase decrypts a passphrase file, which needs no keychain.
+func decryptWithPassphrase(rep *report) {
+	p, err := readPassphrase(false)
+	if err != nil {
+		fail(rep, exitCode(err), err)
+	}
+
+	res, err := kindi.DecryptFileWithPassphrase(rep.Input, p)
+	if err != nil {
+		fail(rep, exitCode(err), err)
+	}
+	rep.setResult(res)
+
+	if !jsonOutput {
+		fmt.Printf("finished decrypting %s into %s\n", rep.Input, res.Output)
+		if note, ok := res.Metadata[kindi.MetaNote]; ok {
+			fmt.Printf("note: %s\n", note)
+		}
+	}
+	succeed(rep)
+}
+
+func initKeychain(configDir string, args []string) {
+	rep := &report{Operation: "init"}
+
+	opts := initOptionsFromEnv()
+	opts.NonInteractive = true
+
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.StringVar(&opts.Email, "email", opts.Email, "gmail address to initialize with")
+	fs.StringVar(&opts.ImagePath, "image", opts.ImagePath, "image (jpeg or png) to hold your certificate")
+	fs.BoolVar(&opts.NoPublish, "no-publish", opts.NoPublish, "don't upload the certificate, run publish later")
+	parseFlags(rep, fs, args)
+
+	if fs.NArg() != 0 {
+		fail(rep, exitUsage, fmt.Errorf("unexpected arguments %v", fs.Args()))
+	}
+
+	err := kindi.InitKeychain(configDir, opts)
+	if err != nil {
+		fail(rep, keychainExitCode(err), fmt.Errorf("Initializing keychain: %w", err))
+	}
+
+	rep.Email = kindi.MyGmail()
+	rep.Fingerprint = kindi.MyKeyFingerprint()
+	if !jsonOutput {
+		fmt.Printf("initialized key %s\n", rep.Fingerprint)
+	}
+	succeed(rep)
+}
+
+func publish(configDir string) {
+	rep := &report{Operation: "publish"}
+
+	err := kindi.Publish(configDir)
+	if err != nil {
+		fail(rep, keychainExitCode(err), err)
+	}
+
+	rep.Email = kindi.MyGmail()
+	rep.Fingerprint = kindi.MyKeyFingerprint()
+	if !jsonOutput {
+		fmt.Printf("certificate for key %s is published\n", rep.Fingerprint)
+	}
+	succeed(rep)
+}
+
+func inspect(configDir, path string) {
+	rep := &report{Operation: "inspect", Input: path}
+
+	err := kindi.OpenKeychain(configDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "no local key available, can't check whether it can decrypt %s: %v\n", path, err)
+	}
+
+	info, err := kindi.Inspect(path)
+	if err != nil {
+		fail(rep, exitCode(err), err)
+	}
+
+	if jsonOutput {
+		rep.Inspect = info
+		succeed(rep)
+	}
+
+	format := "binary"
+	if info.Armored {
+		format = "armored"
+	}
+
+	fmt.Printf("file:            %s (%d bytes, %s)\n", info.Path, info.FileSize, format)
+	fmt.Printf("format version:  %d\n", info.Version)
+	fmt.Printf("cipher suite:    %s\n", info.CipherSuite)
+	fmt.Printf("header size:     %d bytes (wrapped key %d bytes)\n", info.HeaderSize, info.WrappedKeySize)
+	fmt.Printf("encrypted body:  %d bytes\n", info.EncryptedBodySize)
+	if info.ChunkSize > 0 {
+		fmt.Printf("chunk size:      %d bytes\n", info.ChunkSize)
+	}
+	if len(info.Compression) > 0 {
+		fmt.Printf("compression:     %s\n", info.Compression)
+	}
+	if len(info.Padding) > 0 {
+		fmt.Printf("padding:         %s\n", info.Padding)
+	}
+	if len(info.KDF) > 0 {
+		fmt.Printf("passphrase:      %s\n", info.KDF)
+	} else if len(info.Recipients) == 0 {
+		fmt.Printf("recipients:      not recorded in this format version\n")
+	}
+	for _, fp := range info.Recipients {
+		if fp == kindi.MyKeyFingerprint() {
+			fmt.Printf("recipient:       %s (your key)\n", fp)
+		} else {
+			fmt.Printf("recipient:       %s\n", fp)
+		}
+	}
+	if info.CanDecrypt {
+		fmt.Printf("local key:       can decrypt (key %s)\n", kindi.MyKeyFingerprint())
+		fmt.Printf("sender:          %s (signature not verified)\n", info.Sender)
+		fmt.Printf("filename:        %s\n", info.Filename)
+
+		keys := make([]string, 0, len(info.Metadata))
+		for k := range info.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%-17s%s\n", k+":", info.Metadata[k])
+		}
+	} else if len(info.KDF) == 0 {
+		fmt.Printf("local key:       can not decrypt\n")
+	}
+	succeed(rep)
+}
+
+func hide(configDir string, args []string) {
+	rep := &report{Operation: "hide"}
+
+	fs := flag.NewFlagSet("hide", flag.ContinueOnError)
+	to := fs.String("to", "", "recipient gmail address")
+	carrier := fs.String("carrier", "", "image (jpeg or png) to hide the encrypted file in")
+	out := fs.String("out", "", "image to write, defaults to the carrier name with .kindi and the extension of --format")
+	format := fs.String("format", "", "image format to write ("+strings.Join(kindi.CarrierFormats(), ", ")+"), defaults to the one --out names or png")
+	key := fs.String("key", "", "scatter the encrypted file over the image in an order derived from key")
+	noSelf := fs.Bool("no-self", false, "don't let your own key decrypt the file too")
+	parseFlags(rep, fs, args)
+
+	if fs.NArg() != 1 || len(*to) == 0 || len(*carrier) == 0 {
+		fail(rep, exitUsage, fmt.Errorf("hide needs --to, --carrier and exactly one file argument"))
+	}
+	rep.Input = fs.Arg(0)
+
+	err := kindi.InitKeychain(configDir, initOptionsFromEnv())
+	if err != nil {
+		fail(rep, keychainExitCode(err), fmt.Errorf("Initializing keychain: %w", err))
+	}
+
+	opts := &kindi.HideOptions{Output: *out, Format: *format, NoSelf: *noSelf}
+	if len(*key) > 0 {
+		opts.Stego = &kindi.StegoOptions{Key: []byte(*key)}
+	}
+
+	res, err := kindi.HideFile([]byte(*to), rep.Input, *carrier, opts)
+	if err != nil {
+		fail(rep, exitCode(err), err)
+	}
+	rep.setResult(res)
+
+	if !jsonOutput {
+		fmt.Printf("finished hiding file %s in %s\n", rep.Input, res.Output)
+	}
+	succeed(rep)
+}
+
+func reveal(configDir string, args []string) {
+	rep := &report{Operation: "reveal"}
+
+	fs := flag.NewFlagSet("reveal", flag.ContinueOnError)
+	key := fs.String("key", "", "key the file was hidden with")
+	parseFlags(rep, fs, args)
+
+	if fs.NArg() != 1 {
+		fail(rep, exitUsage, fmt.Errorf("reveal takes exactly one image argument"))
+	}
+	rep.Input = fs.Arg(0)
+
+	err := kindi.InitKeychain(configDir, initOptionsFromEnv())
+	if err != nil {
+		fail(rep, keychainExitCode(err), fmt.Errorf("Initializing keychain: %w", err))
+	}
+
+	var opts *kindi.StegoOptions
+	if len(*key) > 0 {
+		opts = &kindi.StegoOptions{Key: []byte(*key)}
+	}
+
+	res, err := kindi.RevealFile(rep.Input, opts)
+	if err != nil {
+		fail(rep, exitCode(err), err)
+	}
+	rep.setResult(res)
+
+	if !jsonOutput {
+		fmt.Printf("finished revealing %s from %s into %s\n", rep.Input, res.Sender, res.Output)
+	}
+	succeed(rep)
 }
 
 func main() {
@@ -52,42 +554,119 @@ func main() {
 	help := flag.Bool("help", false, "show this message")
 	version := flag.Bool("version", false, "show version")
 	to := flag.String("to", "", "recipient gmail address")
+	armor := flag.Bool("armor", false, "write encrypted output as ASCII armored text")
+	noSelf := flag.Bool("no-self", false, "don't let your own key decrypt the file too")
+	compress := flag.String("compress", "", "compress before encrypting (gzip or flate)")
+	pad := flag.String("pad", "", "pad before encrypting (padme or pow2)")
+	note := flag.String("note", "", "note for the recipient, encrypted with the file")
+	naming := flag.String("name", "", "name the encrypted file plain (foo.txt.kindi), random or hash (of its content)")
+	expires := flag.Duration("expires", 0, "tell the recipient the file is stale after this long")
+	flag.BoolVar(&jsonOutput, "json", false, "print a JSON result on stdout")
 
 	flag.Parse()
 
-	if *help || *version {
+	if jsonOutput {
+		kindi.SetConsole(os.Stderr)
+	}
+
+	if *help {
 		flag.Usage()
-		os.Exit(0)
+		os.Exit(exitOK)
 	}
 
-	err := kindi.InitKeychain(*configDir)
-	if err != nil {
-		log.Fatalf("Error: Initializing keychain: %v", err)
+	if *version {
+		if jsonOutput {
+			succeed(&report{Operation: "version", Version: versionStr})
+		}
+		flag.Usage()
+		os.Exit(exitOK)
 	}
 
 	args := flag.Args()
 
+	if len(args) > 0 {
+		switch args[0] {
+		case "init":
+			initKeychain(*configDir, args[1:])
+		case "publish":
+			if len(args) != 1 {
+				fail(&report{Operation: "publish"}, exitUsage, fmt.Errorf("publish takes no arguments"))
+			}
+			publish(*configDir)
+		case "inspect":
+			if len(args) != 2 {
+				fail(&report{Operation: "inspect"}, exitUsage, fmt.Errorf("inspect takes exactly one file argument"))
+			}
+			inspect(*configDir, args[1])
+		case "encrypt":
+			encrypt(*configDir, args[1:])
+		case "hide":
+			hide(*configDir, args[1:])
+		case "reveal":
+			reveal(*configDir, args[1:])
+		}
+	}
+
+	rep := &report{Operation: "init"}
+	if len(args) == 1 {
+		rep = &report{Operation: "decrypt", Input: args[0]}
+		if len(*to) > 0 {
+			rep.Operation = "encrypt"
+		} else if needs, err := kindi.NeedsPassphrase(args[0]); err == nil && needs {
+			decryptWithPassphrase(rep)
+		}
+	}
+
+	err := kindi.InitKeychain(*configDir, initOptionsFromEnv())
+	if err != nil {
+		fail(rep, keychainExitCode(err), fmt.Errorf("Initializing keychain: %w", err))
+	}
+
+	if len(args) == 0 {
+		if !jsonOutput {
+			flag.Usage()
+		}
+		succeed(rep)
+	}
+
 	if len(args) != 1 {
 		flag.Usage()
-		os.Exit(0)
+		fail(&report{Operation: "usage"}, exitUsage, fmt.Errorf("expected exactly one file argument, got %d", len(args)))
 	}
 
 	if len(*to) > 0 {
-		fmt.Printf("encrypting file %v\n", args[0])
+		if !jsonOutput {
+			fmt.Printf("encrypting file %v\n", args[0])
+		}
 
-		err := kindi.EncryptFile([]byte(*to), args[0])
+		opts := encryptOptions(*armor, *noSelf, *compress, *pad, *note, *naming, *expires)
+
+		res, err := kindi.EncryptFile([]byte(*to), args[0], opts)
 		if err != nil {
-			log.Fatalf("Error: encrypting file %v: %v", args[0], err)
+			fail(rep, exitCode(err), err)
 		}
-		fmt.Printf("finished encrypting file %s\n", args[0])
+		rep.setResult(res)
 
+		if !jsonOutput {
+			fmt.Printf("finished encrypting file %s into %s\n", args[0], res.Output)
+		}
 	} else {
-		fmt.Printf("decrypting %v\n", args[0])
+		if !jsonOutput {
+			fmt.Printf("decrypting %v\n", args[0])
+		}
 
-		out, sender, err := kindi.DecryptFile(args[0])
+		res, err := kindi.DecryptFile(args[0])
 		if err != nil {
-			log.Fatalf("Error: decrypting file %v: %v", args[0], err)
+			fail(rep, exitCode(err), err)
+		}
+		rep.setResult(res)
+
+		if !jsonOutput {
+			fmt.Printf("finished decrypting %s from %s into %s\n", args[0], res.Sender, res.Output)
+			if note, ok := res.Metadata[kindi.MetaNote]; ok {
+				fmt.Printf("note from %s: %s\n", res.Sender, note)
+			}
 		}
-		fmt.Printf("finished decrypting %s from %s into %s\n", args[0], sender, out)
 	}
+	succeed(rep)
 }